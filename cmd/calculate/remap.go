@@ -30,7 +30,7 @@ func calculateRemap(c *cli.Context) error {
 			workloadsResource[ID] = resourcetypes.RawParams{}
 			_ = mapstructure.Decode(data, workloadsResource[ID])
 		}
-		// NO NEED REMAP rbd
+		// remap distributes node QoS budget to the volumes without QoS limits
 		return s.CalculateRemap(c.Context, nodename, workloadsResource)
 	})
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/projecteru2/core/utils"
 	"github.com/urfave/cli/v2"
 	"github.com/yuyang0/resource-rbd/rbd"
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
 )
 
 var (
@@ -23,12 +24,17 @@ func Serve(c *cli.Context, f func(s *rbd.Plugin, in resourcetypes.RawParams) (in
 		return cli.Exit(err, 128)
 	}
 
+	rbdCfg, err := rbdtypes.LoadConfig(ConfigPath)
+	if err != nil {
+		return cli.Exit(err, 128)
+	}
+
 	var t *testing.T
 	if EmbeddedStorage {
 		t = &testing.T{}
 	}
 
-	s, err := rbd.NewPlugin(c.Context, cfg, t)
+	s, err := rbd.NewPlugin(c.Context, cfg, rbdCfg, t)
 	if err != nil {
 		return cli.Exit(err, 128)
 	}
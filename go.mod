@@ -5,11 +5,13 @@ go 1.20
 require (
 	github.com/cockroachdb/errors v1.9.1
 	github.com/docker/go-units v0.5.0
+	github.com/jinzhu/configor v1.2.1
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/projecteru2/core v0.0.0-20231019042116-435f703768f4
 	github.com/sanity-io/litter v1.5.5
 	github.com/stretchr/testify v1.8.2
 	github.com/urfave/cli/v2 v2.25.1
+	go.etcd.io/etcd/client/v3 v3.5.8
 )
 
 require (
@@ -40,7 +42,6 @@ require (
 	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0 // indirect
 	github.com/grpc-ecosystem/grpc-gateway v1.16.0 // indirect
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.15.2 // indirect
-	github.com/jinzhu/configor v1.2.1 // indirect
 	github.com/jonboulle/clockwork v0.4.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
@@ -71,7 +72,6 @@ require (
 	go.etcd.io/etcd/api/v3 v3.5.8 // indirect
 	go.etcd.io/etcd/client/pkg/v3 v3.5.8 // indirect
 	go.etcd.io/etcd/client/v2 v2.305.8 // indirect
-	go.etcd.io/etcd/client/v3 v3.5.8 // indirect
 	go.etcd.io/etcd/pkg/v3 v3.5.8 // indirect
 	go.etcd.io/etcd/raft/v3 v3.5.8 // indirect
 	go.etcd.io/etcd/server/v3 v3.5.8 // indirect
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/cockroachdb/errors"
 	"github.com/projecteru2/core/resource/plugins"
 	coretypes "github.com/projecteru2/core/types"
 
@@ -14,14 +15,30 @@ import (
 	"github.com/yuyang0/resource-rbd/cmd/node"
 	"github.com/yuyang0/resource-rbd/cmd/rbd"
 	rbdlib "github.com/yuyang0/resource-rbd/rbd"
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
 	"github.com/yuyang0/resource-rbd/version"
 
 	"github.com/urfave/cli/v2"
 )
 
+const configPathEnv = "ERU_RESOURCE_CONFIG_PATH"
+
+// NewPlugin is used by eru-core to embed the plugin,
+// the rbd section is loaded from the config file given by ERU_RESOURCE_CONFIG_PATH since eru-core config doesn't include it
 func NewPlugin(ctx context.Context, config coretypes.Config) (plugins.Plugin, error) {
-	p, err := rbdlib.NewPlugin(ctx, config, nil)
-	return p, err
+	configPath := os.Getenv(configPathEnv)
+	if configPath == "" {
+		return nil, errors.Wrapf(coretypes.ErrConfigInvaild, "%s must be set to load rbd config", configPathEnv)
+	}
+	rbdCfg, err := rbdtypes.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	p, err := rbdlib.NewPlugin(ctx, config, rbdCfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 func main() {
@@ -58,7 +75,7 @@ func main() {
 			Value:       "rbd.yaml",
 			Usage:       "config file path for plugin, in yaml",
 			Destination: &cmd.ConfigPath,
-			EnvVars:     []string{"ERU_RESOURCE_CONFIG_PATH"},
+			EnvVars:     []string{configPathEnv},
 		},
 		&cli.BoolFlag{
 			Name:        "embedded-storage",
@@ -2,10 +2,13 @@ package rbd
 
 import (
 	"context"
+	"sort"
 
+	"github.com/cockroachdb/errors"
 	"github.com/projecteru2/core/log"
 	plugintypes "github.com/projecteru2/core/resource/plugins/types"
 	resourcetypes "github.com/projecteru2/core/resource/types"
+	coretypes "github.com/projecteru2/core/types"
 	"github.com/sanity-io/litter"
 	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
 )
@@ -22,27 +25,77 @@ func (p Plugin) CalculateDeploy(
 	if err := req.Parse(resourceRequest); err != nil {
 		return nil, err
 	}
-	if err := req.Validate(); err != nil {
+	if err := req.ValidateDeploy(); err != nil {
 		logger.Errorf(ctx, err, "invalid resource opts %+v", req)
 		return nil, err
 	}
+	if err := p.rbdConfig.ValidateClusters(req.Volumes); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
+
+	if err := p.rbdConfig.ApplyImageDefaults(req.Volumes); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
+
+	// a fixed image can't be written by multiple replicas unless it is marked as shared
+	for _, vb := range req.Volumes {
+		if deployCount > 1 && !vb.IsImageTemplate() && !vb.IsShared() && !vb.IsReadOnly() {
+			err := errors.Wrapf(rbdtypes.ErrInvalidVolumes, "image %s can't be used by %d replicas, use image template or shared flag", vb.GetSource(), deployCount)
+			logger.Error(ctx, err)
+			return nil, err
+		}
+	}
+
+	if err := p.checkMappedVolumes(ctx, nodename, deployCount*len(req.Volumes)); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
 
 	var enginesParams []*rbdtypes.EngineParams
 	var workloadsResource []*rbdtypes.WorkloadResource
 
+	seenSrc := map[string]struct{}{}
 	for i := 0; i < deployCount; i++ {
 		wrkRes := rbdtypes.NewWorkloadResoure()
 		eParams := rbdtypes.EngineParams{}
 		for _, vb := range req.Volumes {
 			vb1 := *vb
+			if vb.IsImageTemplate() {
+				image, err := vb.RenderImage(nodename, i)
+				if err != nil {
+					return nil, err
+				}
+				vb1.Image = image
+				if _, ok := seenSrc[vb1.GetSource()]; ok {
+					return nil, errors.Wrapf(rbdtypes.ErrInvalidVolumes, "image template %s renders duplicated image: %s", vb.Image, vb1.GetSource())
+				}
+				seenSrc[vb1.GetSource()] = struct{}{}
+			}
 			wrkRes.Volumes = append(wrkRes.Volumes, &vb1)
-			eParams.Volumes = append(eParams.Volumes, vb1.ToString(true))
+			eParams.AddVolume(&vb1)
 		}
 		enginesParams = append(enginesParams, &eParams)
 		workloadsResource = append(workloadsResource, wrkRes)
 	}
+	// replicas of shared image have the same source, so only check the first workload for them
+	vbs := rbdtypes.VolumeBindings{}
+	for i, wrkRes := range workloadsResource {
+		for _, vb := range wrkRes.Volumes {
+			if i == 0 || !vb.IsShared() {
+				vbs = append(vbs, vb)
+			}
+		}
+	}
+	if err := p.checkImageOwners(ctx, nodename, vbs); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
+
 	epRaws := make([]resourcetypes.RawParams, 0, len(enginesParams))
 	for _, ep := range enginesParams {
+		ep.SetClusters(p.rbdConfig.Clusters)
 		epRaws = append(epRaws, ep.AsRawParams())
 	}
 	wrRaws := make([]resourcetypes.RawParams, 0, len(workloadsResource))
@@ -65,19 +118,52 @@ func (p Plugin) CalculateRealloc(
 ) {
 	logger := log.WithFunc("resource.rbd.CalculateRealloc").WithField("node", nodename)
 	req := &rbdtypes.WorkloadResourceRequest{}
-	if err := req.Parse(resourceRequest); err != nil {
+	var err error
+	if err = req.Parse(resourceRequest); err != nil {
 		return nil, err
 	}
-	if err := req.Validate(); err != nil {
+	if err = req.Validate(); err != nil {
+		return nil, err
+	}
+	if err = p.rbdConfig.ValidateClusters(req.Volumes); err != nil {
+		logger.Error(ctx, err)
 		return nil, err
 	}
 	originResource := &rbdtypes.WorkloadResource{}
-	if err := originResource.Parse(resource); err != nil {
+	if err = originResource.Parse(resource); err != nil {
+		return nil, err
+	}
+	// new volumes in realloc request may also use image template
+	for _, vb := range req.Volumes {
+		if vb.Image, err = vb.RenderImage(nodename, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// the existing volumes keep their own options after merged with the resize requests,
+	// so image defaults only take effect on the new volumes, set and update can't change the existing images
+	resized := rbdtypes.VolumeBindings{}
+	for _, vb := range req.Volumes {
+		if vb.Action == rbdtypes.ReallocResize {
+			resized = append(resized, vb)
+		}
+	}
+	if err = p.rbdConfig.ApplyImageDefaults(resized); err != nil {
+		logger.Error(ctx, err)
 		return nil, err
 	}
 
+	volumes, err := req.ApplyTo(originResource.Volumes)
+	if err != nil {
+		logger.Errorf(ctx, err, "failed to apply realloc request %+v", litter.Sdump(req))
+		return nil, err
+	}
+	if err := p.checkShrink(req.Volumes, originResource.Volumes, volumes); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
 	req = &rbdtypes.WorkloadResourceRequest{
-		Volumes: rbdtypes.MergeVolumeBindings(req.Volumes, originResource.Volumes),
+		Volumes: volumes,
 	}
 
 	if err := req.Validate(); err != nil {
@@ -88,21 +174,41 @@ func (p Plugin) CalculateRealloc(
 	targetWorkloadResource := &rbdtypes.WorkloadResource{
 		Volumes: req.Volumes,
 	}
-	originResSet := map[[3]string]any{}
+	originResSet := map[[4]string]any{}
+	originSrcSet := map[string]any{}
 	for _, vb := range originResource.Volumes {
 		originResSet[vb.GetMapKey()] = struct{}{}
+		originSrcSet[vb.GetSource()] = struct{}{}
+	}
+
+	// the images already used by this workload are owned by itself
+	newVolumes := rbdtypes.VolumeBindings{}
+	for _, vb := range targetWorkloadResource.Volumes {
+		if _, ok := originSrcSet[vb.GetSource()]; !ok {
+			newVolumes = append(newVolumes, vb)
+		}
+	}
+	if err := p.checkImageOwners(ctx, nodename, newVolumes); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
 	}
 	engineParams := &rbdtypes.EngineParams{
 		Storage:       targetWorkloadResource.Size(),
 		VolumeChanged: len(originResSet) != len(targetWorkloadResource.Volumes),
+		Actions:       rbdtypes.NewVolumeActions(originResource.Volumes, targetWorkloadResource.Volumes),
 	}
 	for _, vb := range targetWorkloadResource.Volumes {
 		if _, ok := originResSet[vb.GetMapKey()]; !ok {
 			engineParams.VolumeChanged = true
 		}
-		engineParams.Volumes = append(engineParams.Volumes, vb.ToString(true))
+		engineParams.AddVolume(vb)
 	}
 	deltaWorkloadResource := getDeltaWorkloadResourceArgs(originResource, targetWorkloadResource)
+	if err := p.checkReallocCapacity(ctx, nodename, deltaWorkloadResource); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
+	engineParams.SetClusters(p.rbdConfig.Clusters)
 	return &plugintypes.CalculateReallocResponse{
 		EngineParams:     engineParams.AsRawParams(),
 		DeltaResource:    deltaWorkloadResource.AsRawParams(),
@@ -110,30 +216,157 @@ func (p Plugin) CalculateRealloc(
 	}, nil
 }
 
-// CalculateRemap .
+// CalculateRemap distributes the node QoS budget to the volumes without QoS limits
 func (p Plugin) CalculateRemap(
-	context.Context, string,
-	map[string]plugintypes.WorkloadResource,
+	ctx context.Context, nodename string,
+	workloadsResource map[string]plugintypes.WorkloadResource,
 ) (
 	*plugintypes.CalculateRemapResponse, error,
 ) {
-	return &plugintypes.CalculateRemapResponse{
-		EngineParamsMap: nil,
-	}, nil
+	resp := &plugintypes.CalculateRemapResponse{}
+	if len(workloadsResource) == 0 {
+		return resp, nil
+	}
+	logger := log.WithFunc("resource.rbd.CalculateRemap").WithField("node", nodename)
+	nodeResourceInfo, err := p.doGetNodeResourceInfo(ctx, nodename)
+	if err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
+	// use the QoS capacity of node as budget, fallback to config for the nodes without it
+	budget := &nodeResourceInfo.Capacity.QoS
+	if budget.IsZero() {
+		if budget, err = p.rbdConfig.NodeQoSBudget(); err != nil {
+			logger.Error(ctx, err)
+			return nil, err
+		}
+	}
+	if budget.IsZero() {
+		return resp, nil
+	}
+
+	// sort IDs to make the result stable
+	IDs := make([]string, 0, len(workloadsResource))
+	for ID := range workloadsResource {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	workloadResourceMap := map[string]*rbdtypes.WorkloadResource{}
+	originQoSMap := map[string]*rbdtypes.QoS{}
+	vbs := rbdtypes.VolumeBindings{}
+	for _, ID := range IDs {
+		workloadResource := &rbdtypes.WorkloadResource{}
+		if err := workloadResource.Parse(workloadsResource[ID]); err != nil {
+			return nil, err
+		}
+		workloadResourceMap[ID] = workloadResource
+		originQoSMap[ID] = workloadResource.Volumes.QoS()
+		vbs = append(vbs, workloadResource.Volumes...)
+	}
+	if !rbdtypes.DistributeQoS(budget, vbs) {
+		return resp, nil
+	}
+
+	resp.EngineParamsMap = map[string]plugintypes.EngineParams{}
+	for _, ID := range IDs {
+		workloadResource := workloadResourceMap[ID]
+		// limits are only set on the unlimited bindings, so the total is changed if any binding is changed
+		if *workloadResource.Volumes.QoS() == *originQoSMap[ID] {
+			continue
+		}
+		engineParams := &rbdtypes.EngineParams{
+			Storage: workloadResource.Size(),
+			Remap:   true,
+		}
+		for _, vb := range workloadResource.Volumes {
+			engineParams.AddVolume(vb)
+		}
+		engineParams.SetClusters(p.rbdConfig.Clusters)
+		resp.EngineParamsMap[ID] = engineParams.AsRawParams()
+	}
+	return resp, nil
 }
 
+// checkReallocCapacity returns error if the grown pools in delta resource exceed the available resource of node
+func (p Plugin) checkReallocCapacity(ctx context.Context, nodename string, deltaWorkloadResource *rbdtypes.WorkloadResource) error {
+	deltaResource := deltaWorkloadResource.AsNodeResource()
+	grownPools := []string{}
+	for pool, size := range deltaResource.Pools {
+		if size > 0 {
+			grownPools = append(grownPools, pool)
+		}
+	}
+	if len(grownPools) == 0 {
+		return p.checkMappedVolumes(ctx, nodename, deltaResource.MappedVolumes)
+	}
+	sort.Strings(grownPools)
+
+	nodeResourceInfo, err := p.doGetNodeResourceInfo(ctx, nodename)
+	if err != nil {
+		return err
+	}
+	availableResource := p.getAvailableResource(nodeResourceInfo)
+	for _, pool := range grownPools {
+		if size := deltaResource.Pools[pool]; size > availableResource.Pools[pool] {
+			return errors.Wrapf(coretypes.ErrInsufficientResource, "pool %s on node %s: %d > %d", pool, nodename, size, availableResource.Pools[pool])
+		}
+	}
+	return p.checkMappedVolumes(ctx, nodename, deltaResource.MappedVolumes)
+}
+
+// checkMappedVolumes returns error if mapping count more volumes exceeds the mapped volumes capacity of node
+func (p Plugin) checkMappedVolumes(ctx context.Context, nodename string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	nodeResourceInfo, err := p.doGetNodeResourceInfo(ctx, nodename)
+	if err != nil {
+		return err
+	}
+	capacity := nodeResourceInfo.Capacity.MappedVolumes
+	if capacity > 0 && nodeResourceInfo.Usage.MappedVolumes+count > capacity {
+		return errors.Wrapf(coretypes.ErrInsufficientResource, "mapped volumes on node %s: %d + %d > %d", nodename, nodeResourceInfo.Usage.MappedVolumes, count, capacity)
+	}
+	return nil
+}
+
+// checkShrink returns error if any volume in target is smaller than the origin one,
+// unless the request binding has force shrink flag or the pool allows shrink.
+// The volumes removed from target are detached rather than shrunk.
+func (p Plugin) checkShrink(reqVolumes, originVolumes, targetVolumes rbdtypes.VolumeBindings) error {
+	originMap := map[[4]string]*rbdtypes.VolumeBinding{}
+	for _, vb := range originVolumes {
+		originMap[vb.GetMapKey()] = vb
+	}
+	reqMap := map[[4]string]*rbdtypes.VolumeBinding{}
+	for _, vb := range reqVolumes {
+		reqMap[vb.GetMapKey()] = vb
+	}
+	for _, vb := range targetVolumes {
+		originVB, ok := originMap[vb.GetMapKey()]
+		if !ok || vb.SizeInBytes >= originVB.SizeInBytes {
+			continue
+		}
+		if reqVB, ok := reqMap[vb.GetMapKey()]; ok && reqVB.AllowShrink() {
+			continue
+		}
+		if p.rbdConfig.AllowShrink(vb.GetPoolKey()) {
+			continue
+		}
+		return errors.Wrapf(rbdtypes.ErrShrinkForbidden, "%s: %d -> %d, use f flag or allow_shrink of pool to force it", vb.Destination, originVB.SizeInBytes, vb.SizeInBytes)
+	}
+	return nil
+}
+
+// getDeltaWorkloadResourceArgs returns the delta of realloc which replaces origin volumes with target volumes
 func getDeltaWorkloadResourceArgs(originResource, targetWorkloadResource *rbdtypes.WorkloadResource) *rbdtypes.WorkloadResource {
 	ans := rbdtypes.NewWorkloadResoure()
-	originSeen := map[[3]string]*rbdtypes.VolumeBinding{}
-	for _, vb := range originResource.Volumes {
-		originSeen[vb.GetMapKey()] = vb
-	}
 	for _, vb := range targetWorkloadResource.Volumes {
-		newVB := *vb
-		if originVB, ok := originSeen[vb.GetMapKey()]; ok {
-			newVB.SizeInBytes = vb.SizeInBytes - originVB.SizeInBytes
-		}
-		ans.Volumes = append(ans.Volumes, &newVB)
+		ans.Volumes = append(ans.Volumes, vb.DeepCopy())
+	}
+	for _, vb := range originResource.Volumes {
+		ans.Origin = append(ans.Origin, vb.DeepCopy())
 	}
 	return ans
 }
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/cockroachdb/errors"
 	"github.com/docker/go-units"
 	"github.com/mitchellh/mapstructure"
 	plugintypes "github.com/projecteru2/core/resource/plugins/types"
+	coretypes "github.com/projecteru2/core/types"
 	"github.com/sanity-io/litter"
 	"github.com/stretchr/testify/assert"
 	"github.com/yuyang0/resource-rbd/rbd/types"
@@ -38,11 +40,11 @@ func TestCalculateDeploy(t *testing.T) {
 		}
 		return
 	}
-	// normal case
+	// normal case, replicas share the fixed images
 	req = plugintypes.WorkloadResourceRequest{
 		"volumes": []string{
-			fmt.Sprintf("eru/img0:/dir0:rwm:%v", units.GiB),
-			fmt.Sprintf("eru/img1:/dir1:rwm:%v", units.GiB),
+			fmt.Sprintf("eru/img0:/dir0:rwms:%v", units.GiB),
+			fmt.Sprintf("eru/img1:/dir1:rwms:%v", units.GiB),
 		},
 	}
 	d, err := st.CalculateDeploy(ctx, node, 10, req)
@@ -54,6 +56,266 @@ func TestCalculateDeploy(t *testing.T) {
 		fmt.Sprintf("eru/img0:/dir0:rw:%v", units.GiB))
 	assert.Equal(t, eParams[0].Volumes[1],
 		fmt.Sprintf("eru/img1:/dir1:rw:%v", units.GiB))
+
+	// multiple replicas can't write the same image without shared flag
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{
+			fmt.Sprintf("eru/img0:/dir0:rwm:%v", units.GiB),
+			fmt.Sprintf("eru/img1:/dir1:rwm:%v", units.GiB),
+		},
+	}
+	_, err = st.CalculateDeploy(ctx, node, 10, req)
+	assert.True(t, errors.Is(err, types.ErrInvalidVolumes))
+	d, err = st.CalculateDeploy(ctx, node, 1, req)
+	assert.NoError(t, err)
+	eParams, _ = parse(d)
+	assert.Len(t, eParams, 1)
+
+	// shared or read-only image
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{
+			fmt.Sprintf("eru/img0:/dir0:rws:%v", units.GiB),
+			fmt.Sprintf("eru/img1:/dir1:r:%v", units.GiB),
+		},
+	}
+	d, err = st.CalculateDeploy(ctx, node, 10, req)
+	assert.NoError(t, err)
+	eParams, wrs := parse(d)
+	assert.Len(t, eParams, 10)
+	for i := range eParams {
+		assert.Equal(t, eParams[i].Volumes[0],
+			fmt.Sprintf("eru/img0:/dir0:rw:%v", units.GiB))
+		assert.Equal(t, wrs[i].Volumes[0].Flags, "rsw")
+	}
+
+	// image template
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{
+			fmt.Sprintf("eru/{{.Nodename}}-{{.Index}}:/dir0:rw:%v", units.GiB),
+			fmt.Sprintf("eru/AUTO:/dir1:rw:%v", units.GiB),
+			fmt.Sprintf("ssd/AUTO:/dir2:rw:%v", units.GiB),
+		},
+	}
+	d, err = st.CalculateDeploy(ctx, node, 3, req)
+	assert.NoError(t, err)
+	eParams, wrs = parse(d)
+	assert.Len(t, eParams, 3)
+	seen := map[string]bool{}
+	for i := range eParams {
+		assert.Equal(t, eParams[i].Volumes[0],
+			fmt.Sprintf("eru/%s-%d:/dir0:rw:%v", node, i, units.GiB))
+		assert.Regexp(t, fmt.Sprintf("^%s-%d-[a-z]{8}$", node, i), wrs[i].Volumes[1].Image)
+		for _, vb := range wrs[i].Volumes {
+			assert.False(t, seen[vb.GetSource()])
+			seen[vb.GetSource()] = true
+		}
+	}
+
+	// template renders duplicated images
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/{{.Nodename}}:/dir0:rw:1GiB"},
+	}
+	_, err = st.CalculateDeploy(ctx, node, 2, req)
+	assert.True(t, errors.Is(err, types.ErrInvalidVolumes))
+
+	// invalid template
+	for _, volume := range []string{
+		"eru/{{.Nodename:/dir0:rw:1GiB",
+		"eru/{{.Unknown}}:/dir0:rw:1GiB",
+		"eru/AUTO:/dir0:rws:1GiB",
+	} {
+		req = plugintypes.WorkloadResourceRequest{
+			"volumes": []string{volume},
+		}
+		_, err = st.CalculateDeploy(ctx, node, 1, req)
+		assert.Truef(t, errors.Is(err, types.ErrInvalidVolume), "%s", volume)
+	}
+
+	// filesystem
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{
+			"eru/img0:/dir0:rw:1GiB;fs=xfs,mount=noatime|nodiratime",
+			"eru/img1:/dir1:rw:1GiB;fs=none",
+			"eru/img2:/dir2:rw:1GiB",
+		},
+	}
+	d, err = st.CalculateDeploy(ctx, node, 1, req)
+	assert.NoError(t, err)
+	eParams, _ = parse(d)
+	assert.Equal(t, fmt.Sprintf("eru/img0:/dir0:rw:%v;fs=xfs,mount=noatime|nodiratime", units.GiB), eParams[0].Volumes[0])
+	assert.Equal(t, []*types.VolumeParams{
+		{Source: "eru/img0", Destination: "/dir0", FS: "xfs", MountOptions: []string{"noatime", "nodiratime"}},
+		{Source: "eru/img1", Destination: "/dir1", FS: types.FSNone},
+		{Source: "eru/img2", Destination: "/dir2"},
+	}, eParams[0].VolumesParams)
+
+	// raw block device
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/AUTO:/dev/vdb:rwb:1GiB"},
+	}
+	d, err = st.CalculateDeploy(ctx, node, 2, req)
+	assert.NoError(t, err)
+	eParams, wrs = parse(d)
+	for i := range eParams {
+		assert.True(t, eParams[i].VolumesParams[0].Block)
+		assert.Equal(t, "/dev/vdb", eParams[i].VolumesParams[0].Destination)
+		assert.True(t, wrs[i].Volumes[0].IsBlock())
+	}
+
+	// absolute size and detach are only used by realloc
+	for _, r := range []plugintypes.WorkloadResourceRequest{
+		{"volumes": []string{"eru/img0:/dir0:rw:=1GiB"}},
+		{"volumes": []string{"eru/img0:/dir0:rw:="}},
+		{"volumes": []string{"eru/img0:/dir0:rw:1GiB"}, "volumes-detach": []string{"/dir1"}},
+	} {
+		_, err = st.CalculateDeploy(ctx, node, 1, r)
+		assert.Error(t, err, "%v", r)
+		_, err = st.GetNodesDeployCapacity(ctx, nodes, r)
+		assert.Error(t, err, "%v", r)
+	}
+}
+
+func TestCalculateDeployMultiCluster(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	cluster := &types.ClusterConfig{
+		Monitors: []string{"10.0.0.1:6789", "10.0.0.2:6789"},
+		User:     "eru",
+		Keyring:  "/etc/ceph/c1.client.eru.keyring",
+	}
+	st.rbdConfig = &types.Config{Clusters: map[string]*types.ClusterConfig{"c1": cluster}}
+	setNodesCapacity(ctx, t, st, nodes, "eru:1GiB", "c1@eru:10GiB")
+
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"c1@eru/ns/img0:/dir0:rw:2GiB", "eru/img0:/dir1:rw:1GiB"},
+	}
+	// capacity is keyed by cluster and pool
+	r, err := st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, r.Total)
+	req["volumes"] = []string{"c1@eru/ns/img0:/dir0:rw:2GiB"}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, r.Total)
+
+	d, err := st.CalculateDeploy(ctx, node, 1, req)
+	assert.NoError(t, err)
+	ep := &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EnginesParams[0]))
+	assert.Equal(t, []string{fmt.Sprintf("c1@eru/ns/img0:/dir0:rw:%v", 2*units.GiB)}, ep.Volumes)
+	assert.Equal(t, "c1", ep.VolumesParams[0].Cluster)
+	assert.Equal(t, "eru/ns/img0", ep.VolumesParams[0].Source)
+	assert.Equal(t, map[string]*types.ClusterConfig{"c1": cluster}, ep.Clusters)
+	wr := &types.WorkloadResource{}
+	assert.NoError(t, wr.Parse(d.WorkloadsResource[0]))
+	assert.Equal(t, types.PoolMap{"c1@eru": 2 * units.GiB}, wr.AsNodeResource().Pools)
+
+	// unknown cluster
+	req["volumes"] = []string{"c2@eru/img0:/dir0:rw:1GiB"}
+	_, err = st.CalculateDeploy(ctx, node, 1, req)
+	assert.ErrorIs(t, err, types.ErrInvalidVolume)
+	_, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.ErrorIs(t, err, types.ErrInvalidVolume)
+}
+
+func TestCalculateDeployClone(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	setNodesCapacity(ctx, t, st, nodes, "eru:10GiB")
+
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/golden@v1:/dir0:rw:1GiB"},
+	}
+	d, err := st.CalculateDeploy(ctx, node, 2, req)
+	assert.NoError(t, err)
+	images := map[string]struct{}{}
+	for i := 0; i < 2; i++ {
+		ep := &types.EngineParams{}
+		assert.NoError(t, ep.Parse(d.EnginesParams[i]))
+		assert.Len(t, ep.VolumesParams, 1)
+		assert.Equal(t, "eru/golden@v1", ep.VolumesParams[0].Parent)
+		assert.NotEqual(t, "eru/golden", ep.VolumesParams[0].Source)
+		images[ep.VolumesParams[0].Source] = struct{}{}
+
+		wr := &types.WorkloadResource{}
+		assert.NoError(t, wr.Parse(d.WorkloadsResource[i]))
+		assert.Equal(t, "eru/golden@v1", wr.Volumes[0].GetParent())
+	}
+	// every replica has its own clone
+	assert.Len(t, images, 2)
+
+	// clone is accounted by its own size, so the size must be given
+	for _, volume := range []string{
+		"eru/golden@v1:/dir0:rw",
+		"eru/golden@v1:/dir0:rw:0",
+		"eru/img0:/dir0:rw;parent=golden@v1",
+	} {
+		_, err = st.CalculateDeploy(ctx, node, 1, plugintypes.WorkloadResourceRequest{"volumes": []string{volume}})
+		assert.ErrorIs(t, err, types.ErrInvalidVolumes, volume)
+	}
+}
+
+func TestCalculateDeployImageDefaults(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	st.rbdConfig = &types.Config{Pools: map[string]types.PoolConfig{
+		"eru": {Features: []string{"layering", "exclusive-lock"}, ObjectSize: "8MiB", StripeUnit: "1MiB", StripeCount: 4},
+	}}
+	setNodesCapacity(ctx, t, st, nodes, "eru:10GiB")
+
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes": []string{
+			"eru/img0:/dir0:rw:1GiB",
+			"eru/img1:/dir1:rw:1GiB;features=layering,object_size=4MiB",
+			"eru/img2:/dir2:r:1GiB",
+		},
+	}
+	d, err := st.CalculateDeploy(ctx, node, 1, req)
+	assert.NoError(t, err)
+	ep := &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EnginesParams[0]))
+	// pool defaults
+	assert.Equal(t, []string{"layering", "exclusive-lock"}, ep.VolumesParams[0].Features)
+	assert.Equal(t, int64(8*units.MiB), ep.VolumesParams[0].ObjectSize)
+	assert.Equal(t, int64(units.MiB), ep.VolumesParams[0].StripeUnit)
+	assert.Equal(t, int64(4), ep.VolumesParams[0].StripeCount)
+	// volume options override the defaults, and the layout is not mixed
+	assert.Equal(t, []string{"layering"}, ep.VolumesParams[1].Features)
+	assert.Equal(t, int64(4*units.MiB), ep.VolumesParams[1].ObjectSize)
+	assert.Zero(t, ep.VolumesParams[1].StripeUnit)
+	assert.Zero(t, ep.VolumesParams[1].StripeCount)
+	// read-only volume doesn't create image
+	assert.Nil(t, ep.VolumesParams[2].Features)
+	// the defaults are kept in workload resource
+	wr := &types.WorkloadResource{}
+	assert.NoError(t, wr.Parse(d.WorkloadsResource[0]))
+	assert.Equal(t, int64(8*units.MiB), wr.Volumes[0].ObjectSize())
+
+	// layering is added to the default features of clone, but not to the features of volume
+	st.rbdConfig.Pools["eru"] = types.PoolConfig{Features: []string{"exclusive-lock"}}
+	d, err = st.CalculateDeploy(ctx, node, 1, plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/golden@v1:/dir0:rw:1GiB", "eru/img1:/dir1:rw:1GiB"},
+	})
+	assert.NoError(t, err)
+	ep = &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EnginesParams[0]))
+	assert.Equal(t, []string{"layering", "exclusive-lock"}, ep.VolumesParams[0].Features)
+	assert.Equal(t, []string{"exclusive-lock"}, ep.VolumesParams[1].Features)
+	_, err = st.CalculateDeploy(ctx, node, 1, plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/golden@v1:/dir0:rw:1GiB;features=exclusive-lock"},
+	})
+	assert.ErrorIs(t, err, types.ErrInvalidVolume)
+
+	// invalid defaults
+	st.rbdConfig.Pools["eru"] = types.PoolConfig{Features: []string{"object-map"}}
+	_, err = st.CalculateDeploy(ctx, node, 1, req)
+	assert.ErrorIs(t, err, types.ErrInvalidVolume)
 }
 
 func TestCalculateRealloc(t *testing.T) {
@@ -61,6 +323,7 @@ func TestCalculateRealloc(t *testing.T) {
 	st := initRBD(ctx, t)
 	nodes := generateNodes(ctx, t, st, 1, 0)
 	node := nodes[0]
+	setNodesCapacity(ctx, t, st, nodes, "eru:10TiB", "ssd:10TiB")
 
 	bindings, err := types.NewVolumeBindings([]string{
 		"eru/img0:/dir0:rw:100GiB",
@@ -101,6 +364,8 @@ func TestCalculateRealloc(t *testing.T) {
 	assert.NoError(t, err)
 	eParam, wResource, _ := parse(d)
 	assert.False(t, eParam.VolumeChanged)
+	assert.Len(t, eParam.Actions, 1)
+	assert.Equal(t, types.VolumeGrow, eParam.Actions[0].Type)
 
 	assert.Len(t, wResource.Volumes, 3)
 	vbs := &types.VolumeBindings{}
@@ -116,16 +381,33 @@ func TestCalculateRealloc(t *testing.T) {
 	// 2. delete One
 	req = plugintypes.WorkloadResourceRequest{
 		"volume-request": []string{
-			"eru/img1:/dir1:mrw:-100GiB",
-			"eru/img2:/dir2:rw:-2TB",
-			"eru/img3:/dir3:rw:-2TB",
 			"eru/img4:/dir4:rw:2TB",
 		},
+		"volumes-detach": []string{"/dir1", "/dir2"},
+	}
+	// volumes are only removed by detach, shrinking to zero or a missing volume is rejected
+	for _, v := range []string{
+		"eru/img1:/dir1:mrw:-100GiB",
+		"eru/img2:/dir2:rw:-2TB",
+		"eru/img3:/dir3:rw:-2TB",
+	} {
+		_, err = st.CalculateRealloc(ctx, node, resource, plugintypes.WorkloadResourceRequest{"volume-request": []string{v}})
+		assert.ErrorIs(t, err, types.ErrInvalidVolumes, v)
 	}
 	d, err = st.CalculateRealloc(ctx, node, resource, req)
 	assert.NoError(t, err)
 	eParam, wResource, _ = parse(d)
 	assert.True(t, eParam.VolumeChanged)
+	// keep the origin order and append new volumes
+	for i := 0; i < 10; i++ {
+		d, err = st.CalculateRealloc(ctx, node, resource, req)
+		assert.NoError(t, err)
+		eParam, _, _ = parse(d)
+		assert.Equal(t, []string{
+			fmt.Sprintf("eru/img0:/dir0:rw:%v", 100*units.GiB),
+			fmt.Sprintf("eru/img4:/dir4:rw:%v", 2*units.TiB),
+		}, eParam.Volumes)
+	}
 
 	assert.Len(t, wResource.Volumes, 2)
 	vbs = &types.VolumeBindings{}
@@ -136,6 +418,215 @@ func TestCalculateRealloc(t *testing.T) {
 	]
 	`)))
 	assert.Truef(t, vbs.Equal(wResource.Volumes), "===\n%s\n===\n%s\n", litter.Sdump(vbs), litter.Sdump(&wResource.Volumes))
+
+	// 3. add one with image template
+	req = plugintypes.WorkloadResourceRequest{
+		"volume-request": []string{"eru/AUTO:/dir5:rw:1GiB"},
+	}
+	d, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	eParam, wResource, _ = parse(d)
+	assert.True(t, eParam.VolumeChanged)
+	assert.Len(t, wResource.Volumes, 4)
+	for _, vb := range wResource.Volumes {
+		assert.False(t, vb.IsImageTemplate())
+	}
+
+	// 4. detach, set absolute size and update QoS without resize
+	req = plugintypes.WorkloadResourceRequest{
+		"volume-request": []string{
+			"eru/img0:/dir0:rw:=200GiB",
+			"eru/img1:/dir1:r:=:100:100:0:0",
+		},
+		"volumes-detach": []string{"/dir2"},
+	}
+	d, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	eParam, wResource, dResource := parse(d)
+	assert.True(t, eParam.VolumeChanged)
+	assert.Equal(t, []string{
+		fmt.Sprintf("eru/img0:/dir0:rw:%v", 200*units.GiB),
+		fmt.Sprintf("eru/img1:/dir1:r:%v:100:100:0:0", 100*units.GiB),
+	}, eParam.Volumes)
+	actions := []types.VolumeActionType{}
+	for _, action := range eParam.Actions {
+		actions = append(actions, action.Type)
+	}
+	assert.Equal(t, []types.VolumeActionType{types.VolumeDetach, types.VolumeGrow, types.VolumeFlagsUpdate, types.VolumeQoSUpdate}, actions)
+	assert.Equal(t, "/dir2", eParam.Actions[0].Destination)
+	assert.Empty(t, eParam.Actions[0].New)
+	assert.Equal(t, fmt.Sprintf("eru/img0:/dir0:rw:%v", 100*units.GiB), eParam.Actions[1].Old)
+	assert.Equal(t, fmt.Sprintf("eru/img0:/dir0:rw:%v", 200*units.GiB), eParam.Actions[1].New)
+	assert.Len(t, wResource.Volumes, 2)
+	assert.Len(t, dResource.Origin, 3)
+	assert.Equal(t, int64(100*units.GiB)-int64(units.TiB), dResource.AsNodeResource().Pools["eru"])
+
+	// mount options are updated without resize, the flags of origin are kept
+	req = plugintypes.WorkloadResourceRequest{
+		"volume-request": []string{"eru/img1:/dir1:rw:=;mount=noatime"},
+	}
+	d, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	eParam, _, _ = parse(d)
+	assert.Len(t, eParam.Actions, 1)
+	assert.Equal(t, types.VolumeOptionsUpdate, eParam.Actions[0].Type)
+	assert.Equal(t, fmt.Sprintf("eru/img1:/dir1:rw:%v;mount=noatime", 100*units.GiB), eParam.Actions[0].New)
+
+	// absolute size only resizes the volume
+	req = plugintypes.WorkloadResourceRequest{
+		"volume-request": []string{"eru/img1:/dir1:rw:=200GiB"},
+	}
+	d, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	eParam, wResource, _ = parse(d)
+	assert.Len(t, eParam.Actions, 1)
+	assert.Equal(t, types.VolumeGrow, eParam.Actions[0].Type)
+	assert.Equal(t, "mrw", wResource.Volumes[1].Flags)
+
+	// 5. invalid requests
+	for _, r := range []plugintypes.WorkloadResourceRequest{
+		// detach a destination which doesn't exist
+		{"volumes-detach": []string{"/dir3"}},
+		// detach and resize the same destination
+		{"volume-request": []string{"eru/img0:/dir0:rw:1GiB"}, "volumes-detach": []string{"/dir0"}},
+		// set size of a volume which doesn't exist
+		{"volume-request": []string{"eru/img3:/dir3:rw:=1GiB"}},
+		// absolute size must be positive
+		{"volume-request": []string{"eru/img0:/dir0:rw:=0"}},
+		// filesystem can't be changed
+		{"volume-request": []string{"eru/img0:/dir0:rw:=;fs=ext4,mkfs=nodiscard"}},
+	} {
+		_, err = st.CalculateRealloc(ctx, node, resource, r)
+		assert.Error(t, err, "%v", r)
+	}
+}
+
+func TestCalculateReallocCapacity(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	setNodesCapacity(ctx, t, st, nodes, "eru:10GiB", "ssd:10GiB")
+	workloadsResource := []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img0:/dir0:rw:8GiB"}},
+	}
+	_, err := st.SetNodeResourceUsage(ctx, node, nil, nil, workloadsResource, true, true)
+	assert.NoError(t, err)
+
+	resource := workloadsResource[0]
+	for _, volumes := range [][]string{
+		{"eru/img0:/dir0:rw:3GiB"},
+		{"eru/img0:/dir0:rw:=11GiB"},
+		{"eru/img1:/dir1:rw:3GiB"},
+		{"ssd/img1:/dir1:rw:11GiB"},
+	} {
+		req := plugintypes.WorkloadResourceRequest{"volumes": volumes}
+		_, err = st.CalculateRealloc(ctx, node, resource, req)
+		assert.ErrorIs(t, err, coretypes.ErrInsufficientResource, "%v", volumes)
+	}
+	for _, volumes := range [][]string{
+		{"eru/img0:/dir0:rw:2GiB"},
+		{"eru/img0:/dir0:frw:-7GiB", "eru/img1:/dir1:rw:8GiB"},
+		{"ssd/img1:/dir1:rw:10GiB"},
+	} {
+		req := plugintypes.WorkloadResourceRequest{"volumes": volumes}
+		_, err = st.CalculateRealloc(ctx, node, resource, req)
+		assert.NoError(t, err, "%v", volumes)
+	}
+	// the released size of detached volume can be reused
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes":        []string{"eru/img1:/dir1:rw:10GiB"},
+		"volumes-detach": []string{"/dir0"},
+	}
+	_, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+}
+
+func TestMappedVolumesCapacity(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	setNodesCapacity(ctx, t, st, nodes, "eru:10GiB")
+	_, err := st.SetNodeResourceCapacity(ctx, node, nil, plugintypes.NodeResourceRequest{"max-mapped-volumes": 3}, false, true)
+	assert.NoError(t, err)
+	workloadsResource := []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img0:/dir0:rw:1GiB", "eru/img1:/dir1:rw:1GiB"}},
+	}
+	_, err = st.SetNodeResourceUsage(ctx, node, nil, nil, workloadsResource, true, true)
+	assert.NoError(t, err)
+
+	// deploy
+	req := plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/AUTO:/dir0:rw:1GiB"}}
+	_, err = st.CalculateDeploy(ctx, node, 1, req)
+	assert.NoError(t, err)
+	_, err = st.CalculateDeploy(ctx, node, 2, req)
+	assert.ErrorIs(t, err, coretypes.ErrInsufficientResource)
+
+	// realloc
+	resource := workloadsResource[0]
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img2:/dir2:rw:1GiB"}}
+	d, err := st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	_, err = st.SetNodeResourceUsage(ctx, node, nil, nil, []plugintypes.WorkloadResource{d.DeltaResource}, true, true)
+	assert.NoError(t, err)
+	resource = d.WorkloadResource
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img3:/dir3:rw:1GiB"}}
+	_, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.ErrorIs(t, err, coretypes.ErrInsufficientResource)
+	// resize doesn't map new volume
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img2:/dir2:rw:1GiB"}}
+	_, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	// replace a volume
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img3:/dir3:rw:1GiB"}, "volumes-detach": []string{"/dir2"}}
+	_, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+
+	r, err := st.GetNodeResourceInfo(ctx, node, []plugintypes.WorkloadResource{resource})
+	assert.NoError(t, err)
+	assert.Empty(t, r.Diffs)
+	assert.Equal(t, 3, r.Usage["mapped_volumes"])
+}
+
+func TestCalculateReallocShrink(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	setNodesCapacity(ctx, t, st, nodes, "eru:10TiB", "ssd:10TiB")
+
+	resource := plugintypes.WorkloadResource{
+		"volumes": []string{"eru/img0:/dir0:rw:100GiB", "ssd/img1:/dir1:rw:100GiB"},
+	}
+	// shrink is forbidden by default
+	for _, volume := range []string{"eru/img0:/dir0:rw:-1GiB", "eru/img0:/dir0:rw:=1GiB"} {
+		req := plugintypes.WorkloadResourceRequest{"volumes": []string{volume}}
+		_, err := st.CalculateRealloc(ctx, node, resource, req)
+		assert.ErrorIs(t, err, types.ErrShrinkForbidden)
+	}
+	// volume can't be removed by size
+	req := plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img0:/dir0:rw:-100GiB"}}
+	_, err := st.CalculateRealloc(ctx, node, resource, req)
+	assert.ErrorIs(t, err, types.ErrInvalidVolumes)
+
+	// force shrink by flag
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img0:/dir0:frw:=1GiB"}}
+	d, err := st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	wr := &types.WorkloadResource{}
+	assert.NoError(t, wr.Parse(d.WorkloadResource))
+	assert.Equal(t, "rw", wr.Volumes[0].Flags)
+	assert.Equal(t, int64(units.GiB), wr.Volumes[0].SizeInBytes)
+
+	// allow shrink by pool config
+	st.rbdConfig = &types.Config{Pools: map[string]types.PoolConfig{"ssd": {AllowShrink: true}}}
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"ssd/img1:/dir1:rw:-1GiB"}}
+	_, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.NoError(t, err)
+	req = plugintypes.WorkloadResourceRequest{"volumes": []string{"eru/img0:/dir0:rw:-1GiB"}}
+	_, err = st.CalculateRealloc(ctx, node, resource, req)
+	assert.ErrorIs(t, err, types.ErrShrinkForbidden)
 }
 
 func TestCalculateRemap(t *testing.T) {
@@ -146,4 +637,49 @@ func TestCalculateRemap(t *testing.T) {
 	d, err := st.CalculateRemap(ctx, node, nil)
 	assert.NoError(t, err)
 	assert.Nil(t, d.EngineParamsMap)
+
+	workloadsResource := map[string]plugintypes.WorkloadResource{
+		"w1": {"volumes": []string{"eru/img0:/dir0:rw:1GiB:100:100:0:0", "eru/img1:/dir1:rw:1GiB"}},
+		"w2": {"volumes": []string{"eru/img2:/dir2:rw:1GiB"}},
+	}
+	// no budget
+	d, err = st.CalculateRemap(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Nil(t, d.EngineParamsMap)
+
+	st.rbdConfig = &types.Config{NodeQoS: types.QoSConfig{ReadIOPS: 1000, WriteBPS: "100MiB"}}
+	d, err = st.CalculateRemap(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Len(t, d.EngineParamsMap, 2)
+	ep := &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EngineParamsMap["w1"]))
+	assert.True(t, ep.Remap)
+	assert.Equal(t, []string{
+		fmt.Sprintf("eru/img0:/dir0:rw:%v:100:100:0:%v", units.GiB, 100*units.MiB/3),
+		fmt.Sprintf("eru/img1:/dir1:rw:%v:450:0:0:%v", units.GiB, 100*units.MiB/3),
+	}, ep.Volumes)
+	ep = &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EngineParamsMap["w2"]))
+	assert.Equal(t, []string{fmt.Sprintf("eru/img2:/dir2:rw:%v:450:0:0:%v", units.GiB, 100*units.MiB/3)}, ep.Volumes)
+
+	// read-only bindings don't take write budget, and the unchanged workloads are skipped
+	workloadsResource = map[string]plugintypes.WorkloadResource{
+		"w1": {"volumes": []string{"eru/img0:/dir0:rw:1GiB:600:0:0:50MiB"}},
+		"w2": {"volumes": []string{"eru/img1:/dir1:ro:1GiB"}},
+		"w3": {"volumes": []string{"eru/img2:/dir2:rw:1GiB:400:0:0:50MiB"}},
+	}
+	d, err = st.CalculateRemap(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Nil(t, d.EngineParamsMap)
+
+	workloadsResource["w3"] = plugintypes.WorkloadResource{"volumes": []string{"eru/img2:/dir2:rw:1GiB:100:0:0:0"}}
+	d, err = st.CalculateRemap(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Len(t, d.EngineParamsMap, 2)
+	ep = &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EngineParamsMap["w2"]))
+	assert.Equal(t, []string{fmt.Sprintf("eru/img1:/dir1:ro:%v:300:0:0:0", units.GiB)}, ep.Volumes)
+	ep = &types.EngineParams{}
+	assert.NoError(t, ep.Parse(d.EngineParamsMap["w3"]))
+	assert.Equal(t, []string{fmt.Sprintf("eru/img2:/dir2:rw:%v:100:0:0:%v", units.GiB, 50*units.MiB)}, ep.Volumes)
 }
@@ -0,0 +1,265 @@
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+	"github.com/projecteru2/core/log"
+	coretypes "github.com/projecteru2/core/types"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
+)
+
+// imageOwnerChange records the owner of image before changed, nil means the image had no owner
+type imageOwnerChange struct {
+	src   string
+	owner *rbdtypes.ImageOwner
+}
+
+// checkImageOwners returns error if any writable binding uses an image which is owned by other workloads
+func (p Plugin) checkImageOwners(ctx context.Context, nodename string, vbs rbdtypes.VolumeBindings) error {
+	for _, vb := range vbs {
+		if vb.IsReadOnly() {
+			continue
+		}
+		owner, err := p.doGetImageOwner(ctx, vb.GetSource())
+		if err != nil {
+			return err
+		}
+		if owner == nil {
+			continue
+		}
+		// shared image can be used by the replicas on the same node
+		if owner.Nodename != nodename || !vb.IsShared() {
+			return errors.Wrapf(rbdtypes.ErrImageInUse, "%s is owned by node %s", vb.GetSource(), owner.Nodename)
+		}
+	}
+	return nil
+}
+
+// updateImageOwners claims or releases the writable images used by workloads,
+// the origin images in delta resource are updated reversely.
+// The refs of every image are changed by the sum of deltas, so the images kept by realloc are still owned by node.
+// The changes are rolled back on error, otherwise they are returned for rolling back by caller.
+func (p Plugin) updateImageOwners(ctx context.Context, nodename string, workloadsResource []*rbdtypes.WorkloadResource, incr bool) ([]*imageOwnerChange, error) {
+	deltas := map[string]int{}
+	for _, wrkResource := range workloadsResource {
+		claimed, released := wrkResource.Volumes, wrkResource.Origin
+		if !incr {
+			claimed, released = released, claimed
+		}
+		countImageRefs(deltas, claimed, 1)
+		countImageRefs(deltas, released, -1)
+	}
+	return p.applyImageOwnerDeltas(ctx, nodename, deltas)
+}
+
+// rebuildImageOwners makes the refs of images owned by node match the workloads,
+// the images no longer used by workloads are released.
+func (p Plugin) rebuildImageOwners(ctx context.Context, nodename string, workloadsResource []*rbdtypes.WorkloadResource) ([]*imageOwnerChange, error) {
+	deltas := map[string]int{}
+	for _, wrkResource := range workloadsResource {
+		countImageRefs(deltas, wrkResource.Volumes, 1)
+	}
+	owned, err := p.doGetNodeImages(ctx, nodename)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range owned {
+		owner, err := p.doGetImageOwner(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+		if owner != nil && owner.Nodename == nodename {
+			deltas[src] -= owner.GetRefs()
+		}
+	}
+	return p.applyImageOwnerDeltas(ctx, nodename, deltas)
+}
+
+// releaseNodeImages releases all the images owned by node
+func (p Plugin) releaseNodeImages(ctx context.Context, nodename string) error {
+	owned, err := p.doGetNodeImages(ctx, nodename)
+	if err != nil {
+		return err
+	}
+	for _, src := range owned {
+		owner, err := p.doGetImageOwner(ctx, src)
+		if err != nil {
+			return err
+		}
+		// the image is claimed by other node, only the index of this node is removed
+		if owner != nil && owner.Nodename != nodename {
+			if _, err := p.store.Delete(ctx, fmt.Sprintf(nodeImageKey, nodename, src)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.doDeleteImageOwner(ctx, nodename, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackImageOwners restores the owners changed by node in reverse order
+func (p Plugin) rollbackImageOwners(ctx context.Context, nodename string, changes []*imageOwnerChange) {
+	logger := log.WithFunc("resource.rbd.rollbackImageOwners").WithField("node", nodename)
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		var err error
+		if change.owner == nil {
+			err = p.doDeleteImageOwner(ctx, nodename, change.src)
+		} else {
+			err = p.doPutImageOwner(ctx, change.src, change.owner)
+		}
+		if err != nil {
+			logger.Errorf(ctx, err, "failed to roll back owner of image %s", change.src)
+		}
+	}
+}
+
+// countImageRefs adds n to the refs of writable images used by bindings
+func countImageRefs(refs map[string]int, vbs rbdtypes.VolumeBindings, n int) {
+	for _, vb := range vbs {
+		if !vb.IsReadOnly() {
+			refs[vb.GetSource()] += n
+		}
+	}
+}
+
+// applyImageOwnerDeltas releases images ahead of claiming, and rolls back all the changes on error
+func (p Plugin) applyImageOwnerDeltas(ctx context.Context, nodename string, deltas map[string]int) ([]*imageOwnerChange, error) {
+	srcs := make([]string, 0, len(deltas))
+	for src := range deltas {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool {
+		if deltas[srcs[i]] != deltas[srcs[j]] {
+			return deltas[srcs[i]] < deltas[srcs[j]]
+		}
+		return srcs[i] < srcs[j]
+	})
+
+	changes := []*imageOwnerChange{}
+	for _, src := range srcs {
+		change, err := p.updateImageOwner(ctx, nodename, src, deltas[src])
+		if err != nil {
+			p.rollbackImageOwners(ctx, nodename, changes)
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// updateImageOwner adds delta to the refs of image owned by node, the owner is removed when refs drops to 0.
+// Claiming the image owned by other node returns ErrImageInUse, and releasing it does nothing.
+func (p Plugin) updateImageOwner(ctx context.Context, nodename string, src string, delta int) (*imageOwnerChange, error) {
+	if delta == 0 {
+		return nil, nil //nolint
+	}
+	// claim the free image by create-if-absent, so only one node can win
+	if delta > 0 {
+		created, err := p.doCreateImageOwner(ctx, src, &rbdtypes.ImageOwner{Nodename: nodename, Refs: delta})
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			return &imageOwnerChange{src: src}, nil
+		}
+	}
+
+	owner, err := p.doGetImageOwner(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if owner == nil || owner.Nodename != nodename {
+		if delta < 0 {
+			// the image is not owned by this node, nothing to release
+			return nil, nil //nolint
+		}
+		holder := "other node"
+		if owner != nil {
+			holder = owner.Nodename
+		}
+		err := errors.Wrapf(rbdtypes.ErrImageInUse, "%s is owned by %s", src, holder)
+		log.WithFunc("resource.rbd.updateImageOwner").WithField("node", nodename).Error(ctx, err)
+		return nil, err
+	}
+
+	change := &imageOwnerChange{src: src, owner: owner}
+	refs := owner.GetRefs() + delta
+	if refs <= 0 {
+		return change, p.doDeleteImageOwner(ctx, nodename, src)
+	}
+	return change, p.doPutImageOwner(ctx, src, &rbdtypes.ImageOwner{Nodename: nodename, Refs: refs})
+}
+
+func (p Plugin) doGetImageOwner(ctx context.Context, src string) (*rbdtypes.ImageOwner, error) {
+	resp, err := p.store.Get(ctx, fmt.Sprintf(imageOwnerKey, src))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil //nolint
+	}
+	owner := &rbdtypes.ImageOwner{}
+	return owner, json.Unmarshal(resp.Kvs[0].Value, owner)
+}
+
+// doGetNodeImages returns the images owned by node from node index
+func (p Plugin) doGetNodeImages(ctx context.Context, nodename string) ([]string, error) {
+	resp, err := p.store.Get(ctx, fmt.Sprintf(nodeImageKey, nodename, ""), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	srcs := []string{}
+	for _, kv := range resp.Kvs {
+		srcs = append(srcs, string(kv.Value))
+	}
+	return srcs, nil
+}
+
+// doCreateImageOwner creates the owner and node index of image in one transaction,
+// it returns false if the image is already owned
+func (p Plugin) doCreateImageOwner(ctx context.Context, src string, owner *rbdtypes.ImageOwner) (bool, error) {
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return false, err
+	}
+	_, err = p.store.BatchCreate(ctx, map[string]string{
+		fmt.Sprintf(imageOwnerKey, src):                string(data),
+		fmt.Sprintf(nodeImageKey, owner.Nodename, src): src,
+	})
+	if errors.Is(err, coretypes.ErrKeyExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p Plugin) doPutImageOwner(ctx context.Context, src string, owner *rbdtypes.ImageOwner) error {
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	_, err = p.store.BatchPut(ctx, map[string]string{
+		fmt.Sprintf(imageOwnerKey, src):                string(data),
+		fmt.Sprintf(nodeImageKey, owner.Nodename, src): src,
+	})
+	return err
+}
+
+func (p Plugin) doDeleteImageOwner(ctx context.Context, nodename string, src string) error {
+	_, err := p.store.BatchDelete(ctx, []string{
+		fmt.Sprintf(imageOwnerKey, src),
+		fmt.Sprintf(nodeImageKey, nodename, src),
+	})
+	return err
+}
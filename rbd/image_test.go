@@ -0,0 +1,201 @@
+package rbd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mitchellh/mapstructure"
+	plugintypes "github.com/projecteru2/core/resource/plugins/types"
+	"github.com/stretchr/testify/assert"
+
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
+)
+
+func TestImageOwners(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 2, 0)
+	setNodesCapacity(ctx, t, st, nodes, "eru:10TiB")
+
+	workloadsResource := []plugintypes.WorkloadResource{
+		{
+			"volumes": []string{"eru/img0:/dir0:rw:1GiB", "eru/img1:/dir1:r:1GiB"},
+		},
+	}
+	_, err := st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, workloadsResource, true, true)
+	assert.NoError(t, err)
+
+	owner, err := st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0], owner.Nodename)
+	// read-only image has no owner
+	owner, err = st.doGetImageOwner(ctx, "eru/img1")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+
+	// rw binding is rejected on other nodes
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir0:rw:1GiB"},
+	}
+	_, err = st.CalculateDeploy(ctx, nodes[1], 1, req)
+	assert.True(t, errors.Is(err, rbdtypes.ErrImageInUse))
+	// and also on the same node
+	_, err = st.CalculateDeploy(ctx, nodes[0], 1, req)
+	assert.True(t, errors.Is(err, rbdtypes.ErrImageInUse))
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, workloadsResource, true, true)
+	assert.True(t, errors.Is(err, rbdtypes.ErrImageInUse))
+
+	// read-only sharing is allowed
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir0:r:1GiB", "eru/img1:/dir1:rw:1GiB"},
+	}
+	_, err = st.CalculateDeploy(ctx, nodes[1], 1, req)
+	assert.NoError(t, err)
+
+	// realloc
+	origin := &rbdtypes.WorkloadResource{}
+	assert.NoError(t, origin.Parse(workloadsResource[0]))
+	resource := plugintypes.WorkloadResource{}
+	assert.NoError(t, mapstructure.Decode(origin, &resource))
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir0:rw:1GiB"},
+	}
+	_, err = st.CalculateRealloc(ctx, nodes[0], resource, req)
+	assert.NoError(t, err)
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir2:rw:1GiB"},
+	}
+	_, err = st.CalculateRealloc(ctx, nodes[1], plugintypes.WorkloadResource{}, req)
+	assert.True(t, errors.Is(err, rbdtypes.ErrImageInUse))
+
+	// detached image is released by delta usage and claimed again by rollback
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes-detach": []string{"/dir0"},
+	}
+	d, err := st.CalculateRealloc(ctx, nodes[0], resource, req)
+	assert.NoError(t, err)
+	deltas := []plugintypes.WorkloadResource{d.DeltaResource}
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, deltas, true, true)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, deltas, true, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0], owner.Nodename)
+
+	// release
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, workloadsResource, true, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+
+	// rebuild
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, workloadsResource, false, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[1], owner.Nodename)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, []plugintypes.WorkloadResource{}, false, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+}
+
+func TestImageOwnersRefs(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 2, 0)
+	setNodesCapacity(ctx, t, st, nodes, "eru:10TiB")
+
+	// shared image is released by the last replica
+	replica := plugintypes.WorkloadResource{"volumes": []string{"eru/shared:/dir0:rws:1GiB"}}
+	_, err := st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, []plugintypes.WorkloadResource{replica, replica}, true, true)
+	assert.NoError(t, err)
+	owner, err := st.doGetImageOwner(ctx, "eru/shared")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, owner.Refs)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, []plugintypes.WorkloadResource{replica}, true, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/shared")
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0], owner.Nodename)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, []plugintypes.WorkloadResource{replica}, true, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/shared")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+
+	// claims are rolled back if any image is owned by other node
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img0:/dir0:rw:1GiB"}},
+	}, true, true)
+	assert.NoError(t, err)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img1:/dir1:rw:1GiB", "eru/img0:/dir0:rw:1GiB"}},
+	}, true, true)
+	assert.ErrorIs(t, err, rbdtypes.ErrImageInUse)
+	owner, err = st.doGetImageOwner(ctx, "eru/img1")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+	r, err := st.GetNodeResourceInfo(ctx, nodes[1], nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), r.Usage["pools"].(rbdtypes.PoolMap)["eru"])
+
+	// rebuild only releases the images owned by node
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img1:/dir1:rw:1GiB"}},
+	}, false, false)
+	assert.NoError(t, err)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, []plugintypes.WorkloadResource{}, false, false)
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/img1")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+	owner, err = st.doGetImageOwner(ctx, "eru/img0")
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0], owner.Nodename)
+}
+
+func TestImageOwnersNodeLifecycle(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 2, 0)
+	setNodesCapacity(ctx, t, st, nodes, "eru:10TiB")
+
+	// the owners left by a failed deploy are fixed by workloads
+	workloadsResource := []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/imgX:/dir0:rw:1GiB"}},
+	}
+	_, err := st.SetNodeResourceUsage(ctx, nodes[0], nil, nil, workloadsResource, true, true)
+	assert.NoError(t, err)
+	_, err = st.FixNodeResource(ctx, nodes[0], []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/imgY:/dir0:rw:1GiB"}},
+	})
+	assert.NoError(t, err)
+	owner, err := st.doGetImageOwner(ctx, "eru/imgX")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+	owner, err = st.doGetImageOwner(ctx, "eru/imgY")
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0], owner.Nodename)
+
+	// the images owned by removed node are released
+	_, err = st.RemoveNode(ctx, nodes[0])
+	assert.NoError(t, err)
+	owner, err = st.doGetImageOwner(ctx, "eru/imgY")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+	images, err := st.doGetNodeImages(ctx, nodes[0])
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+	_, err = st.CalculateDeploy(ctx, nodes[1], 1, plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/imgY:/dir0:rw:1GiB"},
+	})
+	assert.NoError(t, err)
+}
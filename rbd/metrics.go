@@ -2,6 +2,9 @@ package rbd
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/mitchellh/mapstructure"
 	plugintypes "github.com/projecteru2/core/resource/plugins/types"
@@ -11,25 +14,70 @@ import (
 func (p Plugin) GetMetricsDescription(context.Context) (*plugintypes.GetMetricsDescriptionResponse, error) {
 	resp := &plugintypes.GetMetricsDescriptionResponse{}
 	return resp, mapstructure.Decode([]map[string]any{
-		// {
-		// 	"name":   "rbd_used",
-		// 	"help":   "node used rbd.",
-		// 	"type":   "gauge",
-		// 	"labels": []string{"podname", "nodename"},
-		// },
+		{
+			"name":   "rbd_capacity",
+			"help":   "node provisioned rbd capacity of pool.",
+			"type":   "gauge",
+			"labels": []string{"podname", "nodename", "pool"},
+		},
+		{
+			"name":   "rbd_effective_capacity",
+			"help":   "node rbd capacity of pool with overcommit.",
+			"type":   "gauge",
+			"labels": []string{"podname", "nodename", "pool"},
+		},
+		{
+			"name":   "rbd_used",
+			"help":   "node used rbd of pool.",
+			"type":   "gauge",
+			"labels": []string{"podname", "nodename", "pool"},
+		},
 	}, resp)
 }
 
 // GetMetrics .
-func (p Plugin) GetMetrics(ctx context.Context, podname, nodename string) (*plugintypes.GetMetricsResponse, error) { //nolint
-	// safeNodename := strings.ReplaceAll(nodename, ".", "_")
-	metrics := []map[string]any{
-		// {
-		// 	"name":   "rbd_used",
-		// 	"labels": []string{podname, nodename},
-		// 	"value":  fmt.Sprintf("%+v", 0),
-		// 	"key":    fmt.Sprintf("core.node.%s.rbd.used", safeNodename),
-		// },
+func (p Plugin) GetMetrics(ctx context.Context, podname, nodename string) (*plugintypes.GetMetricsResponse, error) {
+	nodeResourceInfo, err := p.doGetNodeResourceInfo(ctx, nodename)
+	if err != nil {
+		return nil, err
+	}
+	safeNodename := strings.ReplaceAll(nodename, ".", "_")
+	effectivePools := p.rbdConfig.EffectiveCapacity(nodeResourceInfo.Capacity.Pools)
+
+	pools := []string{}
+	for pool := range nodeResourceInfo.Capacity.Pools {
+		pools = append(pools, pool)
+	}
+	for pool := range nodeResourceInfo.Usage.Pools {
+		if _, ok := nodeResourceInfo.Capacity.Pools[pool]; !ok {
+			pools = append(pools, pool)
+		}
+	}
+	sort.Strings(pools)
+
+	metrics := []map[string]any{}
+	for _, pool := range pools {
+		safePool := strings.ReplaceAll(pool, ".", "_")
+		metrics = append(metrics,
+			map[string]any{
+				"name":   "rbd_capacity",
+				"labels": []string{podname, nodename, pool},
+				"value":  fmt.Sprintf("%+v", nodeResourceInfo.Capacity.Pools[pool]),
+				"key":    fmt.Sprintf("core.node.%s.rbd.%s", safeNodename, safePool),
+			},
+			map[string]any{
+				"name":   "rbd_effective_capacity",
+				"labels": []string{podname, nodename, pool},
+				"value":  fmt.Sprintf("%+v", effectivePools[pool]),
+				"key":    fmt.Sprintf("core.node.%s.rbd.%s.effective", safeNodename, safePool),
+			},
+			map[string]any{
+				"name":   "rbd_used",
+				"labels": []string{podname, nodename, pool},
+				"value":  fmt.Sprintf("%+v", nodeResourceInfo.Usage.Pools[pool]),
+				"key":    fmt.Sprintf("core.node.%s.rbd.%s.used", safeNodename, safePool),
+			},
+		)
 	}
 
 	resp := &plugintypes.GetMetricsResponse{}
@@ -0,0 +1,43 @@
+package rbd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/docker/go-units"
+	"github.com/stretchr/testify/assert"
+
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
+)
+
+func TestGetMetricsDescription(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	md, err := st.GetMetricsDescription(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, *md, 3)
+}
+
+func TestGetMetrics(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	st.rbdConfig = &rbdtypes.Config{Pools: map[string]rbdtypes.PoolConfig{"eru": {Overcommit: 1.5}}}
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	setNodesCapacity(ctx, t, st, nodes, "eru:10GiB", "ssd:1GiB")
+
+	_, err := st.GetMetrics(ctx, "testpod", "xxx")
+	assert.Error(t, err)
+
+	m, err := st.GetMetrics(ctx, "testpod", nodes[0])
+	assert.NoError(t, err)
+	assert.Len(t, *m, 6)
+	values := map[string]string{}
+	for _, metric := range *m {
+		values[metric.Key] = metric.Value
+	}
+	assert.Equal(t, fmt.Sprint(10*units.GiB), values["core.node.test0.rbd.eru"])
+	assert.Equal(t, fmt.Sprint(15*units.GiB), values["core.node.test0.rbd.eru.effective"])
+	assert.Equal(t, fmt.Sprint(units.GiB), values["core.node.test0.rbd.ssd.effective"])
+	assert.Equal(t, "0", values["core.node.test0.rbd.ssd.used"])
+}
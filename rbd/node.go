@@ -2,44 +2,122 @@ package rbd
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
 
+	"github.com/cockroachdb/errors"
 	enginetypes "github.com/projecteru2/core/engine/types"
+	"github.com/projecteru2/core/log"
 	plugintypes "github.com/projecteru2/core/resource/plugins/types"
+	coretypes "github.com/projecteru2/core/types"
+	"github.com/projecteru2/core/utils"
+	"github.com/sanity-io/litter"
 
 	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
 )
 
 // AddNode .
-func (p Plugin) AddNode(ctx context.Context, nodename string, resource plugintypes.NodeResourceRequest, info *enginetypes.Info) (*plugintypes.AddNodeResponse, error) { //nolint
-	capacity := &rbdtypes.NodeResource{}
-	usage := &rbdtypes.NodeResource{}
+func (p Plugin) AddNode(ctx context.Context, nodename string, resource plugintypes.NodeResourceRequest, _ *enginetypes.Info) (*plugintypes.AddNodeResponse, error) {
+	// try to get the node resource
+	var err error
+	if _, err = p.doGetNodeResourceInfo(ctx, nodename); err == nil {
+		return nil, coretypes.ErrNodeExists
+	}
+
+	if !errors.Is(err, coretypes.ErrInvaildCount) {
+		log.WithFunc("resource.rbd.AddNode").WithField("node", nodename).Error(ctx, err, "failed to get resource info of node")
+		return nil, err
+	}
+
+	req := &rbdtypes.NodeResourceRequest{}
+	if err := req.Parse(resource); err != nil {
+		return nil, err
+	}
+	// use the pools declared in config if the request omits them
+	if !resource.IsSet("pools") {
+		if req.Pools, err = p.rbdConfig.DefaultCapacity(); err != nil {
+			return nil, err
+		}
+	}
+	// so does the QoS capacity
+	if !rbdtypes.HasQoSRequest(resource) {
+		budget, err := p.rbdConfig.NodeQoSBudget()
+		if err != nil {
+			return nil, err
+		}
+		req.QoS = *budget
+	}
+	if !resource.IsSet("max-mapped-volumes") {
+		req.MappedVolumes = p.rbdConfig.MaxMappedVolumes
+	}
+
+	nodeResourceInfo := &rbdtypes.NodeResourceInfo{
+		Capacity: req.AsNodeResource(),
+		Usage:    rbdtypes.NewNodeResource(),
+	}
+	if err = p.doSetNodeResourceInfo(ctx, nodename, nodeResourceInfo); err != nil {
+		return nil, err
+	}
+
 	return &plugintypes.AddNodeResponse{
-		Capacity: capacity.AsRawParams(),
-		Usage:    usage.AsRawParams(),
+		Capacity: nodeResourceInfo.Capacity.AsRawParams(),
+		Usage:    nodeResourceInfo.Usage.AsRawParams(),
 	}, nil
 }
 
 // RemoveNode .
-func (p Plugin) RemoveNode(ctx context.Context, nodename string) (*plugintypes.RemoveNodeResponse, error) { //nolint
-	return &plugintypes.RemoveNodeResponse{}, nil
+func (p Plugin) RemoveNode(ctx context.Context, nodename string) (*plugintypes.RemoveNodeResponse, error) {
+	logger := log.WithFunc("resource.rbd.RemoveNode").WithField("node", nodename)
+	var err error
+	if _, err = p.store.Delete(ctx, fmt.Sprintf(nodeResourceInfoKey, nodename)); err != nil {
+		logger.Error(ctx, err, "faield to delete node")
+		return &plugintypes.RemoveNodeResponse{}, err
+	}
+	// the images owned by node can't be released by workloads any more
+	if err = p.releaseNodeImages(ctx, nodename); err != nil {
+		logger.Error(ctx, err, "failed to release images")
+	}
+	return &plugintypes.RemoveNodeResponse{}, err
 }
 
 // GetNodesDeployCapacity returns available nodes and total capacity
-func (p Plugin) GetNodesDeployCapacity(ctx context.Context, nodenames []string, resource plugintypes.WorkloadResourceRequest) (*plugintypes.GetNodesDeployCapacityResponse, error) { //nolint
+func (p Plugin) GetNodesDeployCapacity(ctx context.Context, nodenames []string, resource plugintypes.WorkloadResourceRequest) (*plugintypes.GetNodesDeployCapacityResponse, error) {
+	logger := log.WithFunc("resource.rbd.GetNodesDeployCapacity")
+	req := &rbdtypes.WorkloadResourceRequest{}
+	if err := req.Parse(resource); err != nil {
+		return nil, err
+	}
+	if err := req.ValidateDeploy(); err != nil {
+		logger.Errorf(ctx, err, "invalid resource opts %+v", req)
+		return nil, err
+	}
+	if err := p.rbdConfig.ValidateClusters(req.Volumes); err != nil {
+		logger.Error(ctx, err)
+		return nil, err
+	}
+
 	nodesDeployCapacityMap := map[string]*plugintypes.NodeDeployCapacity{}
 	total := 0
 
-	for _, nodename := range nodenames {
-		count := 1000
-		nodeDeployCapacity := &plugintypes.NodeDeployCapacity{
-			Weight:   1,
-			Capacity: count,
-			Usage:    0.001,
-			Rate:     0.0001,
+	nodesResourceInfos, err := p.doGetNodesResourceInfo(ctx, nodenames)
+	if err != nil {
+		return nil, err
+	}
+
+	for nodename, nodeResourceInfo := range nodesResourceInfos {
+		nodeDeployCapacity := p.doGetNodeDeployCapacity(nodeResourceInfo, req)
+		if nodeDeployCapacity.Capacity > 0 {
+			nodesDeployCapacityMap[nodename] = nodeDeployCapacity
+			if total == math.MaxInt || nodeDeployCapacity.Capacity == math.MaxInt {
+				total = math.MaxInt
+			} else {
+				total += nodeDeployCapacity.Capacity
+			}
 		}
-		total += count
-		nodesDeployCapacityMap[nodename] = nodeDeployCapacity
 	}
+
 	return &plugintypes.GetNodesDeployCapacityResponse{
 		NodeDeployCapacityMap: nodesDeployCapacityMap,
 		Total:                 total,
@@ -47,60 +125,395 @@ func (p Plugin) GetNodesDeployCapacity(ctx context.Context, nodenames []string,
 }
 
 // SetNodeResourceCapacity sets the amount of total resource info
-func (p Plugin) SetNodeResourceCapacity(ctx context.Context, nodename string, resource plugintypes.NodeResource, resourceRequest plugintypes.NodeResourceRequest, delta bool, incr bool) (*plugintypes.SetNodeResourceCapacityResponse, error) { //nolint
-	before := &rbdtypes.NodeResource{}
-	after := &rbdtypes.NodeResource{}
+func (p Plugin) SetNodeResourceCapacity(ctx context.Context, nodename string, resource plugintypes.NodeResource, resourceRequest plugintypes.NodeResourceRequest, delta bool, incr bool) (*plugintypes.SetNodeResourceCapacityResponse, error) {
+	logger := log.WithFunc("resource.rbd.SetNodeResourceCapacity").WithField("node", nodename)
+	req, nodeResource, _, nodeResourceInfo, err := p.parseNodeResourceInfos(ctx, nodename, resource, resourceRequest, nil)
+	if err != nil {
+		return nil, err
+	}
+	origin := nodeResourceInfo.Capacity
+	before := origin.DeepCopy()
+
+	if !delta && req != nil {
+		req.LoadFromOrigin(origin, resourceRequest)
+	}
+	nodeResourceInfo.Capacity = p.calculateNodeResource(req, nodeResource, origin, nil, delta, incr)
+
+	if err := p.doSetNodeResourceInfo(ctx, nodename, nodeResourceInfo); err != nil {
+		logger.Errorf(ctx, err, "node resource info %+v", litter.Sdump(nodeResourceInfo))
+		return nil, err
+	}
+
 	return &plugintypes.SetNodeResourceCapacityResponse{
 		Before: before.AsRawParams(),
-		After:  after.AsRawParams(),
+		After:  nodeResourceInfo.Capacity.AsRawParams(),
 	}, nil
 }
 
 // GetNodeResourceInfo .
-func (p Plugin) GetNodeResourceInfo(ctx context.Context, nodename string, workloadsResource []plugintypes.WorkloadResource) (*plugintypes.GetNodeResourceInfoResponse, error) { //nolint
-	capacity := &rbdtypes.NodeResource{}
-	usage := &rbdtypes.NodeResource{}
+func (p Plugin) GetNodeResourceInfo(ctx context.Context, nodename string, workloadsResource []plugintypes.WorkloadResource) (*plugintypes.GetNodeResourceInfoResponse, error) {
+	nodeResourceInfo, _, diffs, err := p.getNodeResourceInfo(ctx, nodename, workloadsResource)
+	if err != nil {
+		return nil, err
+	}
 	return &plugintypes.GetNodeResourceInfoResponse{
-		Capacity: capacity.AsRawParams(),
-		Usage:    usage.AsRawParams(),
-		Diffs:    nil,
+		Capacity: p.capacityRawParams(nodeResourceInfo.Capacity),
+		Usage:    nodeResourceInfo.Usage.AsRawParams(),
+		Diffs:    diffs,
 	}, nil
 }
 
 // SetNodeResourceInfo .
-func (p Plugin) SetNodeResourceInfo(ctx context.Context, nodename string, capacity plugintypes.NodeResource, usage plugintypes.NodeResource) (*plugintypes.SetNodeResourceInfoResponse, error) { //nolint
-	return &plugintypes.SetNodeResourceInfoResponse{}, nil
+func (p Plugin) SetNodeResourceInfo(ctx context.Context, nodename string, capacity plugintypes.NodeResource, usage plugintypes.NodeResource) (*plugintypes.SetNodeResourceInfoResponse, error) {
+	capacityResource := &rbdtypes.NodeResource{}
+	usageResource := &rbdtypes.NodeResource{}
+	if err := capacityResource.Parse(capacity); err != nil {
+		return nil, err
+	}
+	if err := usageResource.Parse(usage); err != nil {
+		return nil, err
+	}
+	resourceInfo := &rbdtypes.NodeResourceInfo{
+		Capacity: capacityResource,
+		Usage:    usageResource,
+	}
+
+	return &plugintypes.SetNodeResourceInfoResponse{}, p.doSetNodeResourceInfo(ctx, nodename, resourceInfo)
 }
 
 // SetNodeResourceUsage .
-func (p Plugin) SetNodeResourceUsage(ctx context.Context, nodename string, resource plugintypes.NodeResource, resourceRequest plugintypes.NodeResourceRequest, workloadsResource []plugintypes.WorkloadResource, delta bool, incr bool) (*plugintypes.SetNodeResourceUsageResponse, error) { //nolint
-	before := &rbdtypes.NodeResource{}
-	after := &rbdtypes.NodeResource{}
+func (p Plugin) SetNodeResourceUsage(ctx context.Context, nodename string, resource plugintypes.NodeResource, resourceRequest plugintypes.NodeResourceRequest, workloadsResource []plugintypes.WorkloadResource, delta bool, incr bool) (*plugintypes.SetNodeResourceUsageResponse, error) {
+	logger := log.WithFunc("resource.rbd.SetNodeResourceUsage").WithField("node", nodename)
+	req, nodeResource, wrksResource, nodeResourceInfo, err := p.parseNodeResourceInfos(ctx, nodename, resource, resourceRequest, workloadsResource)
+	if err != nil {
+		return nil, err
+	}
+	origin := nodeResourceInfo.Usage
+	before := origin.DeepCopy()
+
+	// maintain image owners only if usage is calculated by workloads
+	var ownerChanges []*imageOwnerChange
+	if req == nil && nodeResource == nil && workloadsResource != nil {
+		if delta {
+			ownerChanges, err = p.updateImageOwners(ctx, nodename, wrksResource, incr)
+		} else {
+			ownerChanges, err = p.rebuildImageOwners(ctx, nodename, wrksResource)
+		}
+		if err != nil {
+			logger.Error(ctx, err, "failed to update image owners")
+			return nil, err
+		}
+	}
+
+	nodeResourceInfo.Usage = p.calculateNodeResource(req, nodeResource, origin, wrksResource, delta, incr)
+
+	if err := p.doSetNodeResourceInfo(ctx, nodename, nodeResourceInfo); err != nil {
+		logger.Errorf(ctx, err, "node resource info %+v", litter.Sdump(nodeResourceInfo))
+		// the image owners must not be changed without usage
+		p.rollbackImageOwners(ctx, nodename, ownerChanges)
+		return nil, err
+	}
+
 	return &plugintypes.SetNodeResourceUsageResponse{
 		Before: before.AsRawParams(),
-		After:  after.AsRawParams(),
+		After:  nodeResourceInfo.Usage.AsRawParams(),
 	}, nil
 }
 
-// GetMostIdleNode .
-func (p Plugin) GetMostIdleNode(ctx context.Context, nodenames []string) (*plugintypes.GetMostIdleNodeResponse, error) { //nolint
+// GetMostIdleNode returns the node with the lowest provisioned-to-capacity ratio,
+// the more idle the node is, the higher the priority is.
+// If none of the nodes has rbd capacity, the first node is returned with the lowest priority.
+func (p Plugin) GetMostIdleNode(ctx context.Context, nodenames []string) (*plugintypes.GetMostIdleNodeResponse, error) {
 	var mostIdleNode string
-	if len(nodenames) > 0 {
-		mostIdleNode = nodenames[0]
+	var minUsageRatio = math.MaxFloat64
+
+	nodesResourceInfo, err := p.doGetNodesResourceInfo(ctx, nodenames)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nodename := range nodenames {
+		nodeResourceInfo := nodesResourceInfo[nodename]
+		capacity := p.rbdConfig.EffectiveCapacity(nodeResourceInfo.Capacity.Pools).Total()
+		if capacity <= 0 {
+			continue
+		}
+		usageRatio := float64(nodeResourceInfo.Usage.Pools.Total()) / float64(capacity)
+		if usageRatio < minUsageRatio {
+			mostIdleNode = nodename
+			minUsageRatio = usageRatio
+		}
+	}
+
+	// none of the nodes has rbd capacity
+	if mostIdleNode == "" {
+		if len(nodenames) > 0 {
+			mostIdleNode = nodenames[0]
+		}
+		return &plugintypes.GetMostIdleNodeResponse{
+			Nodename: mostIdleNode,
+			Priority: priority,
+		}, nil
 	}
 	return &plugintypes.GetMostIdleNodeResponse{
 		Nodename: mostIdleNode,
-		Priority: priority,
+		Priority: int(maxPriority * utils.Max(1-minUsageRatio, 0)),
 	}, nil
 }
 
 // FixNodeResource .
-func (p Plugin) FixNodeResource(ctx context.Context, nodename string, workloadsResource []plugintypes.WorkloadResource) (*plugintypes.GetNodeResourceInfoResponse, error) { //nolint
-	capacity := &rbdtypes.NodeResource{}
-	usage := &rbdtypes.NodeResource{}
+func (p Plugin) FixNodeResource(ctx context.Context, nodename string, workloadsResource []plugintypes.WorkloadResource) (*plugintypes.GetNodeResourceInfoResponse, error) {
+	nodeResourceInfo, actuallyWorkloadsUsage, diffs, err := p.getNodeResourceInfo(ctx, nodename, workloadsResource)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(diffs) != 0 {
+		nodeResourceInfo.Usage = actuallyWorkloadsUsage
+		if err = p.doSetNodeResourceInfo(ctx, nodename, nodeResourceInfo); err != nil {
+			log.WithFunc("resource.rbd.FixNodeResource").Error(ctx, err)
+			diffs = append(diffs, err.Error())
+		}
+	}
+
+	// the image owners may be left behind by a failed deploy or remove, so they are rebuilt by workloads too
+	wrksResource := []*rbdtypes.WorkloadResource{}
+	for _, workloadResource := range workloadsResource {
+		wrkResource := &rbdtypes.WorkloadResource{}
+		if err := wrkResource.Parse(workloadResource); err != nil {
+			return nil, err
+		}
+		wrksResource = append(wrksResource, wrkResource)
+	}
+	if _, err = p.rebuildImageOwners(ctx, nodename, wrksResource); err != nil {
+		log.WithFunc("resource.rbd.FixNodeResource").Error(ctx, err, "failed to rebuild image owners")
+		diffs = append(diffs, err.Error())
+	}
+
 	return &plugintypes.GetNodeResourceInfoResponse{
-		Capacity: capacity.AsRawParams(),
-		Usage:    usage.AsRawParams(),
-		Diffs:    nil,
+		Capacity: p.capacityRawParams(nodeResourceInfo.Capacity),
+		Usage:    nodeResourceInfo.Usage.AsRawParams(),
+		Diffs:    diffs,
 	}, nil
 }
+
+// capacityRawParams returns the raw params of capacity with the effective capacity of pools
+func (p Plugin) capacityRawParams(capacity *rbdtypes.NodeResource) plugintypes.NodeResource {
+	params := capacity.AsRawParams()
+	params["effective_pools"] = p.rbdConfig.EffectiveCapacity(capacity.Pools)
+	return params
+}
+
+// getAvailableResource returns the available resource of node with overcommitted pools
+func (p Plugin) getAvailableResource(nodeResourceInfo *rbdtypes.NodeResourceInfo) *rbdtypes.NodeResource {
+	availableResource := nodeResourceInfo.Capacity.DeepCopy()
+	availableResource.Pools = p.rbdConfig.EffectiveCapacity(availableResource.Pools)
+	availableResource.Sub(nodeResourceInfo.Usage)
+	return availableResource
+}
+
+func (p Plugin) getNodeResourceInfo(ctx context.Context, nodename string, workloadsResource []plugintypes.WorkloadResource) (*rbdtypes.NodeResourceInfo, *rbdtypes.NodeResource, []string, error) {
+	logger := log.WithFunc("resource.rbd.getNodeResourceInfo").WithField("node", nodename)
+	nodeResourceInfo, err := p.doGetNodeResourceInfo(ctx, nodename)
+	if err != nil {
+		logger.Error(ctx, err)
+		return nil, nil, nil, err
+	}
+
+	actuallyWorkloadsUsage := rbdtypes.NewNodeResource()
+	for _, workloadResource := range workloadsResource {
+		workloadUsage := &rbdtypes.WorkloadResource{}
+		if err := workloadUsage.Parse(workloadResource); err != nil {
+			logger.Error(ctx, err)
+			return nil, nil, nil, err
+		}
+		actuallyWorkloadsUsage.Add(workloadUsage.AsNodeResource())
+	}
+
+	diffs := []string{}
+
+	pools := map[string]struct{}{}
+	for pool := range nodeResourceInfo.Usage.Pools {
+		pools[pool] = struct{}{}
+	}
+	for pool := range actuallyWorkloadsUsage.Pools {
+		pools[pool] = struct{}{}
+	}
+	for pool := range pools {
+		if nodeResourceInfo.Usage.Pools[pool] != actuallyWorkloadsUsage.Pools[pool] {
+			diffs = append(diffs, fmt.Sprintf("node.Pools[%s] != sum(workload.Pools[%s]): %d != %d", pool, pool, nodeResourceInfo.Usage.Pools[pool], actuallyWorkloadsUsage.Pools[pool]))
+		}
+	}
+	if nodeResourceInfo.Usage.MappedVolumes != actuallyWorkloadsUsage.MappedVolumes {
+		diffs = append(diffs, fmt.Sprintf("node.MappedVolumes != sum(workload.MappedVolumes): %d != %d", nodeResourceInfo.Usage.MappedVolumes, actuallyWorkloadsUsage.MappedVolumes))
+	}
+	if nodeResourceInfo.Usage.QoS != actuallyWorkloadsUsage.QoS {
+		diffs = append(diffs, fmt.Sprintf("node.QoS != sum(workload.QoS): %+v != %+v", nodeResourceInfo.Usage.QoS, actuallyWorkloadsUsage.QoS))
+	}
+	sort.Strings(diffs)
+
+	return nodeResourceInfo, actuallyWorkloadsUsage, diffs, nil
+}
+
+func (p Plugin) doGetNodeResourceInfo(ctx context.Context, nodename string) (*rbdtypes.NodeResourceInfo, error) {
+	resp, err := p.doGetNodesResourceInfo(ctx, []string{nodename})
+	if err != nil {
+		return nil, err
+	}
+	return resp[nodename], err
+}
+
+func (p Plugin) doGetNodesResourceInfo(ctx context.Context, nodenames []string) (map[string]*rbdtypes.NodeResourceInfo, error) {
+	keys := []string{}
+	for _, nodename := range nodenames {
+		keys = append(keys, fmt.Sprintf(nodeResourceInfoKey, nodename))
+	}
+	resps, err := p.store.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*rbdtypes.NodeResourceInfo{}
+
+	for _, resp := range resps {
+		r := &rbdtypes.NodeResourceInfo{}
+		if err := json.Unmarshal(resp.Value, r); err != nil {
+			return nil, err
+		}
+		// fill nil pools of legacy data
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		result[utils.Tail(string(resp.Key))] = r
+	}
+	return result, nil
+}
+
+func (p Plugin) doSetNodeResourceInfo(ctx context.Context, nodename string, resourceInfo *rbdtypes.NodeResourceInfo) error {
+	if err := resourceInfo.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(resourceInfo)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.store.Put(ctx, fmt.Sprintf(nodeResourceInfoKey, nodename), string(data))
+	return err
+}
+
+func (p Plugin) doGetNodeDeployCapacity(nodeResourceInfo *rbdtypes.NodeResourceInfo, req *rbdtypes.WorkloadResourceRequest) *plugintypes.NodeDeployCapacity {
+	availableResource := p.getAvailableResource(nodeResourceInfo)
+	effectivePools := p.rbdConfig.EffectiveCapacity(nodeResourceInfo.Capacity.Pools)
+
+	capacityInfo := &plugintypes.NodeDeployCapacity{
+		Weight:   1,
+		Capacity: math.MaxInt,
+	}
+
+	var used, capacity, requested int64
+	for pool, size := range req.Volumes.PoolSizes() {
+		if size <= 0 {
+			continue
+		}
+		count := int(utils.Max(availableResource.Pools[pool], 0) / size)
+		capacityInfo.Capacity = utils.Min(capacityInfo.Capacity, count)
+
+		used += nodeResourceInfo.Usage.Pools[pool]
+		capacity += effectivePools[pool]
+		requested += size
+	}
+	capacityInfo.Capacity = utils.Min(capacityInfo.Capacity, nodeResourceInfo.QoSDeployCapacity(req.Volumes.QoS()))
+	capacityInfo.Capacity = utils.Min(capacityInfo.Capacity, nodeResourceInfo.MappedVolumesDeployCapacity(len(req.Volumes)))
+	if capacity == 0 {
+		// no pool is requested, so use the usage of the whole node
+		used = nodeResourceInfo.Usage.Pools.Total()
+		capacity = effectivePools.Total()
+	}
+	capacityInfo.Usage = utils.AdvancedDivide(float64(used), float64(capacity))
+	capacityInfo.Rate = utils.AdvancedDivide(float64(requested), float64(capacity))
+	return capacityInfo
+}
+
+// calculateNodeResource priority: node resource request > node resource > workload resource args list
+func (p Plugin) calculateNodeResource(req *rbdtypes.NodeResourceRequest, nodeResource *rbdtypes.NodeResource, origin *rbdtypes.NodeResource, workloadsResource []*rbdtypes.WorkloadResource, delta bool, incr bool) *rbdtypes.NodeResource {
+	var resp *rbdtypes.NodeResource
+	if origin == nil || !delta { // no delta means node resource rewrite with whole new data
+		resp = rbdtypes.NewNodeResource()
+		// without delta the new data is written as a whole,
+		// so incr must be true, otherwise negative values will be set
+		incr = true
+	} else {
+		resp = origin.DeepCopy()
+	}
+
+	if req != nil {
+		nodeResource = req.AsNodeResource()
+	}
+
+	if nodeResource != nil {
+		if incr {
+			resp.Add(nodeResource)
+		} else {
+			resp.Sub(nodeResource)
+		}
+		return resp
+	}
+
+	for _, workloadResource := range workloadsResource {
+		nodeResource = workloadResource.AsNodeResource()
+		if incr {
+			resp.Add(nodeResource)
+		} else {
+			resp.Sub(nodeResource)
+		}
+	}
+	return resp
+}
+
+func (p Plugin) parseNodeResourceInfos(
+	ctx context.Context, nodename string,
+	resource plugintypes.NodeResource,
+	resourceRequest plugintypes.NodeResourceRequest,
+	workloadsResource []plugintypes.WorkloadResource,
+) (
+	*rbdtypes.NodeResourceRequest,
+	*rbdtypes.NodeResource,
+	[]*rbdtypes.WorkloadResource,
+	*rbdtypes.NodeResourceInfo,
+	error,
+) {
+	var req *rbdtypes.NodeResourceRequest
+	var nodeResource *rbdtypes.NodeResource
+	wrksResource := []*rbdtypes.WorkloadResource{}
+
+	if resourceRequest != nil {
+		req = &rbdtypes.NodeResourceRequest{}
+		if err := req.Parse(resourceRequest); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	if resource != nil {
+		nodeResource = &rbdtypes.NodeResource{}
+		if err := nodeResource.Parse(resource); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		nodeResource = nodeResource.DeepCopy()
+	}
+
+	for _, workloadResource := range workloadsResource {
+		wrkResource := &rbdtypes.WorkloadResource{}
+		if err := wrkResource.Parse(workloadResource); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		wrksResource = append(wrksResource, wrkResource)
+	}
+
+	nodeResourceInfo, err := p.doGetNodeResourceInfo(ctx, nodename)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return req, nodeResource, wrksResource, nodeResourceInfo, nil
+}
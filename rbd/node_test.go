@@ -0,0 +1,424 @@
+package rbd
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/docker/go-units"
+	plugintypes "github.com/projecteru2/core/resource/plugins/types"
+	coretypes "github.com/projecteru2/core/types"
+	"github.com/stretchr/testify/assert"
+
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
+)
+
+func TestAddNode(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+
+	// existent node
+	_, err := st.AddNode(ctx, node, nil, nil)
+	assert.Equal(t, err, coretypes.ErrNodeExists)
+
+	// invalid request
+	req := plugintypes.NodeResourceRequest{
+		"pools": []string{"eru:10TiB", "ssd"},
+	}
+	_, err = st.AddNode(ctx, "test1", req, nil)
+	assert.True(t, errors.Is(err, rbdtypes.ErrInvalidCapacity))
+
+	// normal case
+	req = plugintypes.NodeResourceRequest{
+		"pools": []string{"eru:10TiB", "ssd:2TiB"},
+	}
+	r, err := st.AddNode(ctx, "test1", req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rbdtypes.PoolMap{"eru": 10 * units.TiB, "ssd": 2 * units.TiB}, r.Capacity["pools"])
+	assert.Empty(t, r.Usage["pools"])
+
+	// use default capacity in config
+	st.rbdConfig = &rbdtypes.Config{
+		Pools: map[string]rbdtypes.PoolConfig{
+			"eru": {Capacity: "1TiB"},
+			"ssd": {},
+		},
+	}
+	r, err = st.AddNode(ctx, "test2", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rbdtypes.PoolMap{"eru": units.TiB}, r.Capacity["pools"])
+
+	// QoS capacity
+	req = plugintypes.NodeResourceRequest{
+		"read-iops": 10000,
+		"write-bps": "1GiB",
+	}
+	r, err = st.AddNode(ctx, "test3", req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rbdtypes.QoS{ReadIOPS: 10000, WriteBPS: units.GiB}, r.Capacity["qos"])
+	req = plugintypes.NodeResourceRequest{
+		"write-iops": -1,
+	}
+	_, err = st.AddNode(ctx, "test4", req, nil)
+	assert.True(t, errors.Is(err, rbdtypes.ErrInvalidCapacity))
+	for _, name := range []string{"test1", "test2", "test3"} {
+		_, err = st.RemoveNode(ctx, name)
+		assert.NoError(t, err)
+	}
+}
+
+func TestRemoveNode(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+
+	_, err := st.RemoveNode(ctx, node)
+	assert.NoError(t, err)
+	_, err = st.GetNodeResourceInfo(ctx, node, nil)
+	assert.True(t, errors.Is(err, coretypes.ErrInvaildCount))
+
+	// remove non-existent node
+	_, err = st.RemoveNode(ctx, "test1")
+	assert.NoError(t, err)
+}
+
+func TestSetNodeResourceInfo(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+
+	r, err := st.GetNodeResourceInfo(ctx, node, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, r.Diffs)
+
+	capacity := plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 10 * units.TiB, "ssd": units.TiB},
+	}
+	usage := plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": units.TiB},
+	}
+	_, err = st.SetNodeResourceInfo(ctx, node, capacity, usage)
+	assert.NoError(t, err)
+
+	r, err = st.GetNodeResourceInfo(ctx, node, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10*units.TiB), r.Capacity["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(units.TiB), r.Usage["pools"].(rbdtypes.PoolMap)["eru"])
+
+	// negative size
+	usage = plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": -1},
+	}
+	_, err = st.SetNodeResourceInfo(ctx, node, capacity, usage)
+	assert.True(t, errors.Is(err, rbdtypes.ErrInvalidStorage))
+}
+
+func TestSetNodeResourceCapacity(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+
+	resource := plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 10 * units.TiB},
+	}
+	// overwrite
+	r, err := st.SetNodeResourceCapacity(ctx, node, resource, nil, false, false)
+	assert.NoError(t, err)
+	assert.Empty(t, r.Before["pools"])
+	assert.Equal(t, int64(10*units.TiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+
+	// incr
+	resource = plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": units.TiB, "ssd": units.TiB},
+	}
+	r, err = st.SetNodeResourceCapacity(ctx, node, resource, nil, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10*units.TiB), r.Before["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(11*units.TiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(units.TiB), r.After["pools"].(rbdtypes.PoolMap)["ssd"])
+
+	// decr
+	resource = plugintypes.NodeResource{
+		"pools": map[string]int64{"ssd": units.TiB},
+	}
+	r, err = st.SetNodeResourceCapacity(ctx, node, resource, nil, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), r.After["pools"].(rbdtypes.PoolMap)["ssd"])
+
+	// decr too much
+	_, err = st.SetNodeResourceCapacity(ctx, node, resource, nil, true, false)
+	assert.True(t, errors.Is(err, rbdtypes.ErrInvalidStorage))
+
+	// with request
+	req := plugintypes.NodeResourceRequest{
+		"pools": []string{"eru:1TiB"},
+	}
+	r, err = st.SetNodeResourceCapacity(ctx, node, nil, req, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12*units.TiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+
+	r, err = st.SetNodeResourceCapacity(ctx, node, nil, req, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, rbdtypes.PoolMap{"eru": units.TiB}, r.After["pools"])
+
+	// keep the origin capacity if pools are omitted
+	r, err = st.SetNodeResourceCapacity(ctx, node, nil, plugintypes.NodeResourceRequest{}, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, rbdtypes.PoolMap{"eru": units.TiB}, r.After["pools"])
+}
+
+func TestSetNodeResourceUsage(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+
+	workloadsResource := []plugintypes.WorkloadResource{
+		{
+			"volumes": []string{"eru/img0:/dir0:rw:1GiB", "ssd/img1:/dir1:rw:2GiB"},
+		},
+		{
+			"volumes": []string{"eru/img2:/dir0:rw:3GiB"},
+		},
+	}
+
+	// incr with workloads
+	r, err := st.SetNodeResourceUsage(ctx, node, nil, nil, workloadsResource, true, true)
+	assert.NoError(t, err)
+	assert.Empty(t, r.Before["pools"])
+	assert.Equal(t, int64(4*units.GiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(2*units.GiB), r.After["pools"].(rbdtypes.PoolMap)["ssd"])
+
+	// decr with workloads
+	r, err = st.SetNodeResourceUsage(ctx, node, nil, nil, workloadsResource[1:], true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4*units.GiB), r.Before["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(units.GiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+
+	// rebuild from workloads
+	r, err = st.SetNodeResourceUsage(ctx, node, nil, nil, workloadsResource[1:], false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3*units.GiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(0), r.After["pools"].(rbdtypes.PoolMap)["ssd"])
+
+	// resource has higher priority
+	resource := plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": units.GiB},
+	}
+	r, err = st.SetNodeResourceUsage(ctx, node, resource, nil, workloadsResource, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4*units.GiB), r.After["pools"].(rbdtypes.PoolMap)["eru"])
+}
+
+func TestGetNodesDeployCapacity(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 2, 0)
+
+	capacity := plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 10 * units.GiB, "ssd": 4 * units.GiB},
+	}
+	for _, node := range nodes {
+		_, err := st.SetNodeResourceInfo(ctx, node, capacity, nil)
+		assert.NoError(t, err)
+	}
+
+	// non-existent node
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir0:rw:1GiB"},
+	}
+	_, err := st.GetNodesDeployCapacity(ctx, []string{"xxx"}, req)
+	assert.True(t, errors.Is(err, coretypes.ErrInvaildCount))
+
+	// normal
+	r, err := st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, r.Total)
+	assert.Equal(t, 10, r.NodeDeployCapacityMap[nodes[0]].Capacity)
+	assert.Equal(t, 0.1, r.NodeDeployCapacityMap[nodes[0]].Rate)
+
+	// limited by the smallest pool
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir0:rw:1GiB", "ssd/img1:/dir1:rw:2GiB"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, r.Total)
+
+	// with usage
+	_, err = st.SetNodeResourceUsage(ctx, nodes[0], plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 9 * units.GiB},
+	}, nil, nil, true, true)
+	assert.NoError(t, err)
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, r.Total)
+	assert.Equal(t, 1, r.NodeDeployCapacityMap[nodes[0]].Capacity)
+	assert.Equal(t, 9.0/14, r.NodeDeployCapacityMap[nodes[0]].Usage)
+
+	// exhausted pool
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img0:/dir0:rw:2GiB"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, r.Total)
+	assert.NotContains(t, r.NodeDeployCapacityMap, nodes[0])
+
+	// unknown pool
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"hdd/img0:/dir0:rw:1GiB"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, r.Total)
+
+	// no volumes
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, math.MaxInt, r.Total)
+
+	// limited by QoS capacity
+	_, err = st.SetNodeResourceCapacity(ctx, nodes[1], nil, plugintypes.NodeResourceRequest{"read-iops": 1000}, false, true)
+	assert.NoError(t, err)
+	_, err = st.SetNodeResourceUsage(ctx, nodes[1], nil, nil, []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img0:/dir0:rw:1GiB:300:0:0:0"}},
+	}, true, true)
+	assert.NoError(t, err)
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img1:/dir0:rw:1GiB:200:100:0:0"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes[1:], req)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, r.Total)
+	// unlimited volume is not limited by QoS capacity
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img1:/dir0:rw:1GiB"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes[1:], req)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, r.Total)
+
+	// limited by mapped volumes capacity
+	_, err = st.SetNodeResourceCapacity(ctx, nodes[1], nil, plugintypes.NodeResourceRequest{"max-mapped-volumes": 6}, false, true)
+	assert.NoError(t, err)
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img1:/dir0:rw:1MiB", "eru/img2:/dir1:rw:1MiB"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes[1:], req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, r.Total)
+}
+
+func TestOvercommit(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	st.rbdConfig = &rbdtypes.Config{Pools: map[string]rbdtypes.PoolConfig{"eru": {Overcommit: 2}}}
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+	setNodesCapacity(ctx, t, st, nodes, "eru:10GiB", "ssd:10GiB")
+	_, err := st.SetNodeResourceUsage(ctx, node, nil, nil, []plugintypes.WorkloadResource{
+		{"volumes": []string{"eru/img0:/dir0:rw:4GiB", "ssd/img1:/dir1:rw:4GiB"}},
+	}, true, true)
+	assert.NoError(t, err)
+
+	req := plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"eru/img2:/dir0:rw:1GiB"},
+	}
+	r, err := st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 16, r.Total)
+	assert.Equal(t, 0.2, r.NodeDeployCapacityMap[node].Usage)
+	req = plugintypes.WorkloadResourceRequest{
+		"volumes": []string{"ssd/img2:/dir0:rw:1GiB"},
+	}
+	r, err = st.GetNodesDeployCapacity(ctx, nodes, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, r.Total)
+
+	// both raw and effective capacity are shown
+	info, err := st.GetNodeResourceInfo(ctx, node, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rbdtypes.PoolMap{"eru": 10 * units.GiB, "ssd": 10 * units.GiB}, info.Capacity["pools"])
+	assert.Equal(t, rbdtypes.PoolMap{"eru": 20 * units.GiB, "ssd": 10 * units.GiB}, info.Capacity["effective_pools"])
+}
+
+func TestGetMostIdleNode(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 2, 0)
+
+	// no capacity
+	r, err := st.GetMostIdleNode(ctx, nodes)
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[0], r.Nodename)
+	assert.Equal(t, priority, r.Priority)
+
+	capacity := plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 10 * units.GiB},
+	}
+	_, err = st.SetNodeResourceInfo(ctx, nodes[0], capacity, plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 5 * units.GiB},
+	})
+	assert.NoError(t, err)
+	_, err = st.SetNodeResourceInfo(ctx, nodes[1], capacity, plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 2 * units.GiB},
+	})
+	assert.NoError(t, err)
+
+	r, err = st.GetMostIdleNode(ctx, nodes)
+	assert.NoError(t, err)
+	assert.Equal(t, nodes[1], r.Nodename)
+	assert.Equal(t, 160, r.Priority)
+
+	// non-existent node
+	_, err = st.GetMostIdleNode(ctx, []string{"xxx"})
+	assert.True(t, errors.Is(err, coretypes.ErrInvaildCount))
+}
+
+func TestFixNodeResource(t *testing.T) {
+	ctx := context.Background()
+	st := initRBD(ctx, t)
+	nodes := generateNodes(ctx, t, st, 1, 0)
+	node := nodes[0]
+
+	_, err := st.SetNodeResourceInfo(ctx, node, plugintypes.NodeResource{
+		"pools": map[string]int64{"eru": 10 * units.GiB, "ssd": 10 * units.GiB},
+	}, plugintypes.NodeResource{
+		"pools":          map[string]int64{"eru": 5 * units.GiB, "ssd": units.GiB},
+		"mapped_volumes": 3,
+	})
+	assert.NoError(t, err)
+
+	workloadsResource := []plugintypes.WorkloadResource{
+		{
+			"volumes": []string{"eru/img0:/dir0:rw:2GiB", "hdd/img1:/dir1:rw:1GiB"},
+		},
+		{
+			"volumes": []string{"eru/img2:/dir0:rw:3GiB"},
+		},
+	}
+
+	r, err := st.GetNodeResourceInfo(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Len(t, r.Diffs, 2)
+	assert.Contains(t, r.Diffs[0], "hdd")
+	assert.Contains(t, r.Diffs[1], "ssd")
+
+	r, err = st.FixNodeResource(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Len(t, r.Diffs, 2)
+	assert.Equal(t, int64(5*units.GiB), r.Usage["pools"].(rbdtypes.PoolMap)["eru"])
+	assert.Equal(t, int64(units.GiB), r.Usage["pools"].(rbdtypes.PoolMap)["hdd"])
+	assert.Equal(t, int64(0), r.Usage["pools"].(rbdtypes.PoolMap)["ssd"])
+
+	r, err = st.GetNodeResourceInfo(ctx, node, workloadsResource)
+	assert.NoError(t, err)
+	assert.Empty(t, r.Diffs)
+}
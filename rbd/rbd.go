@@ -7,29 +7,37 @@ import (
 	"github.com/projecteru2/core/log"
 	"github.com/projecteru2/core/store/etcdv3/meta"
 	coretypes "github.com/projecteru2/core/types"
+
+	rbdtypes "github.com/yuyang0/resource-rbd/rbd/types"
 )
 
 const (
 	name                = "rbd"
-	rate                = 8
 	nodeResourceInfoKey = "/resource/rbd/%s"
-	priority            = -10000
+	imageOwnerKey       = "/resource/rbd-images/%s"
+	nodeImageKey        = "/resource/rbd-node-images/%s/%s"
+	priority            = -10000 // used when no node has rbd capacity
+	maxPriority         = 200    // used when the most idle node is totally free
 )
 
 // Plugin
 type Plugin struct {
-	name   string
-	config coretypes.Config
-	store  meta.KV
+	name      string
+	config    coretypes.Config
+	rbdConfig *rbdtypes.Config
+	store     meta.KV
 }
 
 // NewPlugin .
-func NewPlugin(ctx context.Context, cfg coretypes.Config, t *testing.T) (*Plugin, error) {
+func NewPlugin(ctx context.Context, cfg coretypes.Config, rbdCfg *rbdtypes.Config, t *testing.T) (*Plugin, error) {
 	if t == nil && len(cfg.Etcd.Machines) < 1 {
 		return nil, coretypes.ErrConfigInvaild
 	}
+	if rbdCfg == nil {
+		rbdCfg = &rbdtypes.Config{}
+	}
 	var err error
-	plugin := &Plugin{name: name, config: cfg}
+	plugin := &Plugin{name: name, config: cfg, rbdConfig: rbdCfg}
 	if plugin.store, err = meta.NewETCD(cfg.Etcd, t); err != nil {
 		log.WithFunc("resource.rbd.NewPlugin").Error(ctx, err)
 		return nil, err
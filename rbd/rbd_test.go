@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"testing"
 
+	plugintypes "github.com/projecteru2/core/resource/plugins/types"
 	coretypes "github.com/projecteru2/core/types"
 	"github.com/stretchr/testify/assert"
 )
@@ -21,7 +22,7 @@ func initRBD(ctx context.Context, t *testing.T) *Plugin {
 		},
 	}
 
-	p, err := NewPlugin(ctx, config, t)
+	p, err := NewPlugin(ctx, config, nil, t)
 	assert.NoError(t, err)
 	return p
 }
@@ -32,7 +33,21 @@ func generateNodes(
 	names := []string{}
 	for i := startIdx; i < startIdx+nums; i++ {
 		name := fmt.Sprintf("test%v", i)
+		_, err := st.AddNode(ctx, name, nil, nil)
+		assert.NoError(t, err)
 		names = append(names, name)
 	}
+	t.Cleanup(func() {
+		for _, name := range names {
+			st.RemoveNode(ctx, name)
+		}
+	})
 	return names
 }
+
+func setNodesCapacity(ctx context.Context, t *testing.T, st *Plugin, nodes []string, pools ...string) {
+	for _, node := range nodes {
+		_, err := st.SetNodeResourceCapacity(ctx, node, nil, plugintypes.NodeResourceRequest{"pools": pools}, false, true)
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,187 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jinzhu/configor"
+	"github.com/projecteru2/core/utils"
+)
+
+// Config is the rbd specific config, it lives in the `rbd` section of the config file
+type Config struct {
+	// Pools are keyed by [cluster@]pool
+	Pools map[string]PoolConfig `yaml:"pools"`
+	// Clusters are the ceph clusters other than the default one, volumes refer to them by cluster@pool/image
+	Clusters map[string]*ClusterConfig `yaml:"clusters"`
+	// NodeQoS is the throughput budget shared by the volumes of every node,
+	// remap distributes the budget left by limited volumes to the unlimited ones
+	NodeQoS QoSConfig `yaml:"node_qos"`
+	// MaxMappedVolumes is the default number of volumes can be mapped on every node, 0 means unlimited
+	MaxMappedVolumes int `yaml:"max_mapped_volumes"`
+}
+
+// ClusterConfig indicate how to connect to a ceph cluster
+type ClusterConfig struct {
+	Monitors []string `yaml:"monitors" json:"monitors" mapstructure:"monitors"`
+	User     string   `yaml:"user" json:"user" mapstructure:"user"`
+	Keyring  string   `yaml:"keyring" json:"keyring" mapstructure:"keyring"` // path of keyring file on node
+}
+
+// QoSConfig indicate the throughput limits, 0 means unlimited
+type QoSConfig struct {
+	ReadIOPS  int64  `yaml:"read_iops"`
+	WriteIOPS int64  `yaml:"write_iops"`
+	ReadBPS   string `yaml:"read_bps"` // e.g. 500MiB
+	WriteBPS  string `yaml:"write_bps"`
+}
+
+// PoolConfig indicate the config of a ceph pool
+type PoolConfig struct {
+	Capacity    string `yaml:"capacity"`     // default capacity of the pool when adding node, e.g. 10TiB
+	AllowShrink bool   `yaml:"allow_shrink"` // allow realloc to shrink the volumes of the pool
+	// Overcommit is the thin-provisioning overcommit ratio of the pool,
+	// the effective capacity is capacity * overcommit, 0 means no overcommit
+	Overcommit float64 `yaml:"overcommit"`
+	// Features, ObjectSize and striping are the defaults of the images created in the pool,
+	// the volume options override them
+	Features    []string `yaml:"features"`
+	ObjectSize  string   `yaml:"object_size"` // e.g. 4MiB
+	StripeUnit  string   `yaml:"stripe_unit"`
+	StripeCount int      `yaml:"stripe_count"`
+}
+
+// imageOptions returns the default image options of pool
+func (c PoolConfig) imageOptions() VolumeOptions {
+	opts := VolumeOptions{}
+	if len(c.Features) > 0 {
+		opts["features"] = strings.Join(c.Features, optionListSeparator)
+	}
+	if c.ObjectSize != "" {
+		opts["object_size"] = c.ObjectSize
+	}
+	if c.StripeUnit != "" {
+		opts["stripe_unit"] = c.StripeUnit
+	}
+	if c.StripeCount != 0 {
+		opts["stripe_count"] = strconv.Itoa(c.StripeCount)
+	}
+	return opts
+}
+
+// LoadConfig loads the rbd section from config file
+func LoadConfig(configPath string) (*Config, error) {
+	cfg := struct {
+		RBD Config `yaml:"rbd"`
+	}{}
+	if err := configor.Load(&cfg, configPath); err != nil {
+		return nil, err
+	}
+	return &cfg.RBD, nil
+}
+
+// DefaultCapacity returns the capacity of pools declared in config
+func (c *Config) DefaultCapacity() (PoolMap, error) {
+	ans := PoolMap{}
+	for pool, poolCfg := range c.Pools {
+		if poolCfg.Capacity == "" {
+			continue
+		}
+		size, err := utils.ParseRAMInHuman(poolCfg.Capacity)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errors.Wrapf(ErrInvalidCapacity, "negative capacity of pool %s: %s", pool, poolCfg.Capacity)
+		}
+		ans[pool] = size
+	}
+	return ans, nil
+}
+
+// AllowShrink returns true if the volumes of pool can be shrunk
+func (c *Config) AllowShrink(pool string) bool {
+	return c.Pools[pool].AllowShrink
+}
+
+// NodeQoSBudget returns the throughput budget of node
+func (c *Config) NodeQoSBudget() (*QoS, error) {
+	budget := &QoS{
+		ReadIOPS:  c.NodeQoS.ReadIOPS,
+		WriteIOPS: c.NodeQoS.WriteIOPS,
+	}
+	for _, v := range []struct {
+		ptr   *int64
+		value string
+	}{{&budget.ReadBPS, c.NodeQoS.ReadBPS}, {&budget.WriteBPS, c.NodeQoS.WriteBPS}} {
+		if v.value == "" {
+			continue
+		}
+		bps, err := utils.ParseRAMInHuman(v.value)
+		if err != nil {
+			return nil, err
+		}
+		*v.ptr = bps
+	}
+	return budget, budget.Validate()
+}
+
+// OvercommitRatio returns the overcommit ratio of pool
+func (c *Config) OvercommitRatio(pool string) float64 {
+	if ratio := c.Pools[pool].Overcommit; ratio > 0 {
+		return ratio
+	}
+	return 1
+}
+
+// EffectiveCapacity returns the overcommitted capacity of pools
+func (c *Config) EffectiveCapacity(pools PoolMap) PoolMap {
+	ans := PoolMap{}
+	for pool, size := range pools {
+		ans[pool] = int64(float64(size) * c.OvercommitRatio(pool))
+	}
+	return ans
+}
+
+// ApplyImageDefaults fills the image options of writable bindings with the defaults of their pools,
+// the layout defaults are only used when the binding has no layout option,
+// and layering is added to the default features of clones since they can't be created without it
+func (c *Config) ApplyImageDefaults(vbs VolumeBindings) error {
+	for _, vb := range vbs {
+		if vb.IsReadOnly() {
+			continue
+		}
+		defaults := c.Pools[vb.GetPoolKey()].imageOptions()
+		if len(defaults) == 0 {
+			continue
+		}
+		if vb.hasLayoutOption() {
+			for _, key := range imageLayoutOptions {
+				delete(defaults, key)
+			}
+		}
+		if features := defaults.List("features"); vb.GetParent() != "" && len(features) > 0 &&
+			!utils.Any(features, func(f string) bool { return f == featureLayering }) {
+			defaults["features"] = strings.Join(append([]string{featureLayering}, features...), optionListSeparator)
+		}
+		vb.Options = defaults.Merge(vb.Options)
+		if err := vb.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid image defaults of pool %s", vb.GetPoolKey())
+		}
+	}
+	return nil
+}
+
+// ValidateClusters returns error if any binding uses a cluster which is not declared in config
+func (c *Config) ValidateClusters(vbs VolumeBindings) error {
+	for _, vb := range vbs {
+		if vb.Cluster == "" {
+			continue
+		}
+		if _, ok := c.Clusters[vb.Cluster]; !ok {
+			return errors.Wrapf(ErrInvalidVolume, "unknown cluster %s of %s", vb.Cluster, vb.GetSource())
+		}
+	}
+	return nil
+}
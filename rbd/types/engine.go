@@ -6,19 +6,163 @@ import (
 	resourcetypes "github.com/projecteru2/core/resource/types"
 )
 
+// VolumeActionType .
+type VolumeActionType string
+
+const (
+	VolumeAttach      VolumeActionType = "attach"
+	VolumeDetach      VolumeActionType = "detach"
+	VolumeGrow        VolumeActionType = "grow"
+	VolumeShrink      VolumeActionType = "shrink"
+	VolumeQoSUpdate   VolumeActionType = "qos-update"
+	VolumeFlagsUpdate VolumeActionType = "flags-update"
+	// VolumeOptionsUpdate means the mutable options are changed, e.g. mount options
+	VolumeOptionsUpdate VolumeActionType = "options-update"
+)
+
+// VolumeAction describes a change of volume made by realloc,
+// Old and New are the volume strings before and after the change, Old is empty for attach and New is empty for detach
+type VolumeAction struct {
+	Type        VolumeActionType `json:"type" mapstructure:"type"`
+	Destination string           `json:"destination" mapstructure:"destination"`
+	Old         string           `json:"old,omitempty" mapstructure:"old"`
+	New         string           `json:"new,omitempty" mapstructure:"new"`
+}
+
+// NewVolumeActions returns the actions which change origin volumes to target volumes,
+// detach actions come first so that the volumes are unmapped before the new ones are mapped.
+func NewVolumeActions(origin, target VolumeBindings) (actions []*VolumeAction) {
+	originMap := map[[4]string]*VolumeBinding{}
+	for _, vb := range origin {
+		originMap[vb.GetMapKey()] = vb
+	}
+	targetMap := map[[4]string]*VolumeBinding{}
+	for _, vb := range target {
+		targetMap[vb.GetMapKey()] = vb
+	}
+
+	for _, vb := range origin {
+		if _, ok := targetMap[vb.GetMapKey()]; !ok {
+			actions = append(actions, &VolumeAction{Type: VolumeDetach, Destination: vb.Destination, Old: vb.ToString(true)})
+		}
+	}
+	for _, vb := range target {
+		originVB, ok := originMap[vb.GetMapKey()]
+		if !ok {
+			actions = append(actions, &VolumeAction{Type: VolumeAttach, Destination: vb.Destination, New: vb.ToString(true)})
+			continue
+		}
+		newAction := func(typ VolumeActionType) *VolumeAction {
+			return &VolumeAction{Type: typ, Destination: vb.Destination, Old: originVB.ToString(true), New: vb.ToString(true)}
+		}
+		switch {
+		case vb.SizeInBytes > originVB.SizeInBytes:
+			actions = append(actions, newAction(VolumeGrow))
+		case vb.SizeInBytes < originVB.SizeInBytes:
+			actions = append(actions, newAction(VolumeShrink))
+		}
+		// the flags only used by plugin are not passed to engine
+		if vb.normalizedFlags() != originVB.normalizedFlags() {
+			actions = append(actions, newAction(VolumeFlagsUpdate))
+		}
+		if vb.ReadIOPS != originVB.ReadIOPS || vb.WriteIOPS != originVB.WriteIOPS || vb.ReadBPS != originVB.ReadBPS || vb.WriteBPS != originVB.WriteBPS {
+			actions = append(actions, newAction(VolumeQoSUpdate))
+		}
+		if vb.Options.String() != originVB.Options.String() {
+			actions = append(actions, newAction(VolumeOptionsUpdate))
+		}
+	}
+	return actions
+}
+
+// VolumeParams are the parameters of a volume used by engine to prepare it
+type VolumeParams struct {
+	Cluster      string   `json:"cluster,omitempty" mapstructure:"cluster"`
+	Source       string   `json:"source" mapstructure:"source"`           // image spec in format pool[/namespace]/image
+	Parent       string   `json:"parent,omitempty" mapstructure:"parent"` // clone the snapshot in format pool[/namespace]/image@snap instead of creating an empty image
+	Destination  string   `json:"destination" mapstructure:"destination"`
+	Block        bool     `json:"block,omitempty" mapstructure:"block"` // pass the device through to workload instead of mounting it
+	FS           string   `json:"fs,omitempty" mapstructure:"fs"`
+	MkfsOptions  []string `json:"mkfs_options,omitempty" mapstructure:"mkfs_options"`
+	MountOptions []string `json:"mount_options,omitempty" mapstructure:"mount_options"`
+	// Features, ObjectSize and striping are used when creating image, empty means default
+	Features    []string `json:"features,omitempty" mapstructure:"features"`
+	ObjectSize  int64    `json:"object_size,omitempty" mapstructure:"object_size"`
+	StripeUnit  int64    `json:"stripe_unit,omitempty" mapstructure:"stripe_unit"`
+	StripeCount int64    `json:"stripe_count,omitempty" mapstructure:"stripe_count"`
+	// Encryption is the LUKS format, engine resolves the passphrase by EncryptionSecret reference
+	Encryption       string `json:"encryption,omitempty" mapstructure:"encryption"`
+	EncryptionSecret string `json:"encryption_secret,omitempty" mapstructure:"encryption_secret"`
+}
+
+// NewVolumeParams .
+func NewVolumeParams(vb *VolumeBinding) *VolumeParams {
+	return &VolumeParams{
+		Cluster:          vb.Cluster,
+		Source:           vb.GetImageSpec(),
+		Parent:           vb.GetParent(),
+		Destination:      vb.Destination,
+		Block:            vb.IsBlock(),
+		FS:               vb.FS(),
+		MkfsOptions:      vb.MkfsOptions(),
+		MountOptions:     vb.MountOptions(),
+		Features:         vb.Features(),
+		ObjectSize:       vb.ObjectSize(),
+		StripeUnit:       vb.StripeUnit(),
+		StripeCount:      vb.StripeCount(),
+		Encryption:       vb.Encryption(),
+		EncryptionSecret: vb.EncryptionSecret(),
+	}
+}
+
 // EngineParams .
 type EngineParams struct {
 	Volumes       []string `json:"volumes" mapstructure:"volumes"`
 	VolumeChanged bool     `json:"volume_changed" mapstructure:"volume_changed"` // indicates whether the realloc request includes new volumes
 	Storage       int64    `json:"storage" mapstructure:"storage"`
+	Remap         bool     `json:"remap" mapstructure:"remap"` // indicates the QoS of volumes is changed by remap
+	// Actions is only set by realloc
+	Actions []*VolumeAction `json:"actions,omitempty" mapstructure:"actions"`
+	// VolumesParams are in the same order as Volumes
+	VolumesParams []*VolumeParams `json:"volumes_params" mapstructure:"volumes_params"`
+	// Clusters are the clusters used by volumes
+	Clusters map[string]*ClusterConfig `json:"clusters,omitempty" mapstructure:"clusters"`
+}
+
+// SetClusters sets the configs of clusters used by volumes
+func (ep *EngineParams) SetClusters(clusters map[string]*ClusterConfig) {
+	for _, vp := range ep.VolumesParams {
+		if vp.Cluster == "" {
+			continue
+		}
+		if ep.Clusters == nil {
+			ep.Clusters = map[string]*ClusterConfig{}
+		}
+		ep.Clusters[vp.Cluster] = clusters[vp.Cluster]
+	}
+}
+
+// AddVolume appends volume to engine params
+func (ep *EngineParams) AddVolume(vb *VolumeBinding) {
+	ep.Volumes = append(ep.Volumes, vb.ToString(true))
+	ep.VolumesParams = append(ep.VolumesParams, NewVolumeParams(vb))
 }
 
 func (ep *EngineParams) AsRawParams() resourcetypes.RawParams {
-	return resourcetypes.RawParams{
+	params := resourcetypes.RawParams{
 		"volumes":        ep.Volumes,
 		"volume_changed": ep.VolumeChanged,
 		"storage":        ep.Storage,
+		"remap":          ep.Remap,
+		"volumes_params": ep.VolumesParams,
+	}
+	if len(ep.Clusters) > 0 {
+		params["clusters"] = ep.Clusters
+	}
+	if len(ep.Actions) > 0 {
+		params["actions"] = ep.Actions
 	}
+	return params
 }
 
 func (ep *EngineParams) Parse(rawParams resourcetypes.RawParams) (err error) {
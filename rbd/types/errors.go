@@ -8,4 +8,6 @@ var (
 	ErrInvalidStorage  = errors.New("invalid storage")
 	ErrInvalidVolumes  = errors.New("invalid volumes")
 	ErrInvalidParams   = errors.New("invalid io parameters")
+	ErrImageInUse      = errors.New("image is in use")
+	ErrShrinkForbidden = errors.New("volume shrink is forbidden")
 )
@@ -0,0 +1,18 @@
+package types
+
+// ImageOwner indicates which node is writing the image.
+// eru-core only passes the resource of workloads to SetNodeResourceUsage without their IDs,
+// so the owner is identified by node, and Refs counts the writable bindings of the image on the node,
+// e.g. the replicas sharing the image.
+type ImageOwner struct {
+	Nodename string `json:"nodename"`
+	Refs     int    `json:"refs"`
+}
+
+// GetRefs returns the number of bindings using the image, the owners written without refs are used by one binding
+func (o *ImageOwner) GetRefs() int {
+	if o.Refs <= 0 {
+		return 1
+	}
+	return o.Refs
+}
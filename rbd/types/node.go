@@ -1,15 +1,74 @@
 package types
 
 import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
 	"github.com/mitchellh/mapstructure"
 	resourcetypes "github.com/projecteru2/core/resource/types"
+	"github.com/projecteru2/core/utils"
 )
 
-// NodeResource indicate node cpumem resource
-type NodeResource struct{}
+// PoolMap maps ceph pool name to size in bytes,
+// the pools of other clusters than the default one are named as cluster@pool
+type PoolMap map[string]int64
+
+// DeepCopy .
+func (pm PoolMap) DeepCopy() PoolMap {
+	ans := PoolMap{}
+	for pool, size := range pm {
+		ans[pool] = size
+	}
+	return ans
+}
+
+// Add .
+func (pm PoolMap) Add(pm1 PoolMap) {
+	for pool, size := range pm1 {
+		pm[pool] += size
+	}
+}
+
+// Sub .
+func (pm PoolMap) Sub(pm1 PoolMap) {
+	for pool, size := range pm1 {
+		pm[pool] -= size
+	}
+}
+
+// Total .
+func (pm PoolMap) Total() int64 {
+	ans := int64(0)
+	for _, size := range pm {
+		ans += size
+	}
+	return ans
+}
+
+// NodeResource indicate node rbd resource, which is the provisioned bytes of every ceph pool,
+// the throughput reserved by volumes and the number of mapped volumes.
+// 0 of QoS and mapped volumes capacity means unlimited
+type NodeResource struct {
+	Pools         PoolMap `json:"pools" mapstructure:"pools"`
+	QoS           QoS     `json:"qos" mapstructure:"qos"`
+	MappedVolumes int     `json:"mapped_volumes" mapstructure:"mapped_volumes"`
+}
+
+func NewNodeResource() *NodeResource {
+	return &NodeResource{
+		Pools: PoolMap{},
+	}
+}
 
 func (r *NodeResource) AsRawParams() resourcetypes.RawParams {
-	return resourcetypes.RawParams{}
+	return resourcetypes.RawParams{
+		"pools":          r.Pools,
+		"qos":            r.QoS,
+		"mapped_volumes": r.MappedVolumes,
+	}
 }
 
 // Parse .
@@ -17,28 +76,181 @@ func (r *NodeResource) Parse(rawParams resourcetypes.RawParams) error {
 	return mapstructure.Decode(rawParams, r)
 }
 
+// DeepCopy .
+func (r *NodeResource) DeepCopy() *NodeResource {
+	return &NodeResource{
+		Pools:         r.Pools.DeepCopy(),
+		QoS:           r.QoS,
+		MappedVolumes: r.MappedVolumes,
+	}
+}
+
+// Add .
+func (r *NodeResource) Add(r1 *NodeResource) {
+	r.Pools.Add(r1.Pools)
+	r.QoS.Add(&r1.QoS)
+	r.MappedVolumes += r1.MappedVolumes
+}
+
+// Sub .
+func (r *NodeResource) Sub(r1 *NodeResource) {
+	r.Pools.Sub(r1.Pools)
+	r.QoS.Sub(&r1.QoS)
+	r.MappedVolumes -= r1.MappedVolumes
+}
+
 func (r *NodeResource) Validate() error {
-	return nil
+	for _, size := range r.Pools {
+		if size < 0 {
+			return ErrInvalidStorage
+		}
+	}
+	if r.MappedVolumes < 0 {
+		return ErrInvalidStorage
+	}
+	return r.QoS.Validate()
 }
 
-// NodeResourceInfo indicate cpumem capacity and usage
+// NodeResourceInfo indicate rbd capacity and usage
 type NodeResourceInfo struct {
 	Capacity *NodeResource `json:"capacity"`
 	Usage    *NodeResource `json:"usage"`
 }
 
+// DeepCopy .
+func (n *NodeResourceInfo) DeepCopy() *NodeResourceInfo {
+	return &NodeResourceInfo{
+		Capacity: n.Capacity.DeepCopy(),
+		Usage:    n.Usage.DeepCopy(),
+	}
+}
+
 func (n *NodeResourceInfo) Validate() error {
+	if n.Capacity == nil {
+		return ErrInvalidCapacity
+	}
+	if n.Usage == nil {
+		n.Usage = NewNodeResource()
+	}
+	// remove nil PoolMap
+	n.Capacity = n.Capacity.DeepCopy()
+	n.Usage = n.Usage.DeepCopy()
+
 	if err := n.Capacity.Validate(); err != nil {
 		return err
 	}
 	return n.Usage.Validate()
 }
 
+// QoSDeployCapacity returns how many workloads requesting qos can be deployed by the QoS capacity
+func (n *NodeResourceInfo) QoSDeployCapacity(qos *QoS) int {
+	ans := math.MaxInt
+	capacity, usage, requested := n.Capacity.QoS.fields(), n.Usage.QoS.fields(), qos.fields()
+	for i := range capacity {
+		if *capacity[i] <= 0 || *requested[i] <= 0 {
+			continue
+		}
+		ans = utils.Min(ans, int(utils.Max(*capacity[i]-*usage[i], 0) / *requested[i]))
+	}
+	return ans
+}
+
+// MappedVolumesDeployCapacity returns how many workloads with count volumes can be deployed by the mapped volumes capacity
+func (n *NodeResourceInfo) MappedVolumesDeployCapacity(count int) int {
+	if n.Capacity.MappedVolumes <= 0 || count <= 0 {
+		return math.MaxInt
+	}
+	return utils.Max(n.Capacity.MappedVolumes-n.Usage.MappedVolumes, 0) / count
+}
+
 // NodeResourceRequest includes all possible fields passed by eru-core for editing node, it not parsed!
 type NodeResourceRequest struct {
-	SizeInBytes int64 `json:"size_in_bytes" mapstructure:"size_in_bytes"`
+	Pools         PoolMap
+	QoS           QoS
+	MappedVolumes int
 }
 
+// qosRequestKeys are the keys of QoS capacity in node resource request, their values can be in human format
+var qosRequestKeys = []string{"read-iops", "write-iops", "read-bps", "write-bps"}
+
+// Parse parses pool capacities in format pool:size, e.g. ["eru:10TiB", "ssd:2TiB"]
 func (n *NodeResourceRequest) Parse(rawParams resourcetypes.RawParams) error {
-	return mapstructure.Decode(rawParams, n)
+	n.Pools = PoolMap{}
+	for _, poolCapacity := range rawParams.StringSlice("pools") {
+		idx := strings.LastIndex(poolCapacity, ":")
+		if idx <= 0 {
+			return errors.Wrapf(ErrInvalidCapacity, "wrong pool capacity format(pool:size): %s", poolCapacity)
+		}
+		pool := poolCapacity[:idx]
+		if _, ok := n.Pools[pool]; ok {
+			return errors.Wrapf(ErrInvalidCapacity, "duplicated pool: %s", pool)
+		}
+		size, err := utils.ParseRAMInHuman(poolCapacity[idx+1:])
+		if err != nil {
+			return errors.Wrapf(ErrInvalidCapacity, "wrong pool capacity size: %s", poolCapacity)
+		}
+		n.Pools[pool] = size
+	}
+
+	n.QoS = QoS{}
+	fields := n.QoS.fields()
+	for i, key := range qosRequestKeys {
+		if !rawParams.IsSet(key) {
+			continue
+		}
+		value, err := utils.ParseRAMInHuman(fmt.Sprintf("%v", rawParams[key]))
+		if err != nil || value < 0 {
+			return errors.Wrapf(ErrInvalidCapacity, "wrong %s: %v", key, rawParams[key])
+		}
+		*fields[i] = value
+	}
+
+	// a malformed value must not be taken as 0, which means unlimited
+	n.MappedVolumes = 0
+	if rawParams.IsSet("max-mapped-volumes") {
+		value, err := strconv.Atoi(fmt.Sprintf("%v", rawParams["max-mapped-volumes"]))
+		if err != nil || value < 0 {
+			return errors.Wrapf(ErrInvalidCapacity, "wrong max-mapped-volumes: %v", rawParams["max-mapped-volumes"])
+		}
+		n.MappedVolumes = value
+	}
+	return nil
+}
+
+// HasQoSRequest returns true if any QoS capacity is set in node resource request
+func HasQoSRequest(rawParams resourcetypes.RawParams) bool {
+	for _, key := range qosRequestKeys {
+		if rawParams.IsSet(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFromOrigin .
+func (n *NodeResourceRequest) LoadFromOrigin(nodeResource *NodeResource, resourceRequest resourcetypes.RawParams) {
+	if n == nil {
+		return
+	}
+	if !resourceRequest.IsSet("pools") {
+		n.Pools = nodeResource.Pools
+	}
+	fields, originFields := n.QoS.fields(), nodeResource.QoS.fields()
+	for i, key := range qosRequestKeys {
+		if !resourceRequest.IsSet(key) {
+			*fields[i] = *originFields[i]
+		}
+	}
+	if !resourceRequest.IsSet("max-mapped-volumes") {
+		n.MappedVolumes = nodeResource.MappedVolumes
+	}
+}
+
+// AsNodeResource .
+func (n *NodeResourceRequest) AsNodeResource() *NodeResource {
+	return &NodeResource{
+		Pools:         n.Pools.DeepCopy(),
+		QoS:           n.QoS,
+		MappedVolumes: n.MappedVolumes,
+	}
 }
@@ -0,0 +1,42 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/docker/go-units"
+	resourcetypes "github.com/projecteru2/core/resource/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeResourceRequest(t *testing.T) {
+	req := &NodeResourceRequest{}
+	assert.NoError(t, req.Parse(nil))
+	assert.Empty(t, req.Pools)
+
+	params := resourcetypes.RawParams{
+		"pools": []string{"eru:10TiB", "ssd:2048"},
+	}
+	assert.NoError(t, req.Parse(params))
+	assert.Equal(t, PoolMap{"eru": 10 * units.TiB, "ssd": 2048}, req.Pools)
+
+	for _, pools := range [][]string{
+		{"eru"},
+		{":10TiB"},
+		{"eru:xxx"},
+		{"eru:1TiB", "eru:2TiB"},
+	} {
+		err := req.Parse(resourcetypes.RawParams{"pools": pools})
+		assert.Truef(t, errors.Is(err, ErrInvalidCapacity), "%v", pools)
+	}
+
+	// max mapped volumes
+	for _, v := range []any{3, "3", float64(3)} {
+		assert.NoError(t, req.Parse(resourcetypes.RawParams{"max-mapped-volumes": v}))
+		assert.Equal(t, 3, req.MappedVolumes)
+	}
+	for _, v := range []any{"3x", "-1", -1, 1.5} {
+		err := req.Parse(resourcetypes.RawParams{"max-mapped-volumes": v})
+		assert.Truef(t, errors.Is(err, ErrInvalidCapacity), "%v", v)
+	}
+}
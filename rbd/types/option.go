@@ -0,0 +1,259 @@
+package types
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/docker/go-units"
+	"github.com/projecteru2/core/utils"
+)
+
+const (
+	optionsSeparator    = ";"
+	optionSeparator     = ","
+	optionKVSeparator   = "="
+	optionListSeparator = "|"
+	optionInvalidChars  = ",;="
+	snapshotSeparator   = "@"
+
+	minObjectSize     = 4 * units.KiB
+	maxObjectSize     = 32 * units.MiB
+	defaultObjectSize = 4 * units.MiB
+
+	featureLayering      = "layering"
+	featureExclusiveLock = "exclusive-lock"
+	featureObjectMap     = "object-map"
+	featureFastDiff      = "fast-diff"
+	featureJournaling    = "journaling"
+
+	// FSNone means the volume is used without filesystem
+	FSNone = "none"
+)
+
+var (
+	fsTypes = []string{"ext4", "xfs", FSNone}
+	// mkfsOptions are translated to the arguments of mkfs by engine
+	mkfsOptions = []string{"nodiscard", "lazy_itable_init", "reflink", "crc"}
+	// mountOptions are passed to mount directly by engine
+	mountOptions = []string{"noatime", "nodiratime", "relatime", "strictatime", "discard", "nodiscard", "noexec", "nosuid", "nodev", "sync", "dirsync"}
+
+	// imageFeatures are the rbd image features can be enabled when creating image
+	imageFeatures = []string{featureLayering, featureExclusiveLock, featureObjectMap, featureFastDiff, featureJournaling}
+	// featureDependencies are the features required by other features
+	featureDependencies = map[string]string{
+		featureObjectMap:  featureExclusiveLock,
+		featureFastDiff:   featureObjectMap,
+		featureJournaling: featureExclusiveLock,
+	}
+
+	// optionValidators includes all the known option keys and their validators
+	optionValidators = map[string]func(string) error{
+		"fs":         oneOf(fsTypes...),
+		"mkfs":       listOf(mkfsOptions...),
+		"mount":      listOf(mountOptions...),
+		"iops_burst": validateNonNegativeInt,
+		"parent":     validateSnapshot,
+		"features":   listOf(imageFeatures...),
+		// sizes are in human size, e.g. 4MiB
+		"object_size":  validateObjectSize,
+		"stripe_unit":  validateObjectSize,
+		"stripe_count": validatePositiveInt,
+		"encryption":   oneOf(encryptionFormats...),
+		// encryption_secret is the reference of passphrase secret resolved by engine, never the passphrase itself
+		"encryption_secret": validateSecretRef,
+	}
+	// imageLayoutOptions decide how the data of image is placed, they can't be changed after image is created
+	imageLayoutOptions = []string{"object_size", "stripe_unit", "stripe_count"}
+	// immutableOptions can't be changed by realloc after image is created,
+	// the passphrase of encrypted image isn't re-keyed either
+	immutableOptions = append([]string{"parent", "encryption", "encryption_secret", "fs", "mkfs"}, imageLayoutOptions...)
+
+	encryptionFormats = []string{"luks1", "luks2"}
+	secretRefPattern  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]*$`)
+)
+
+// VolumeOptions are the key=value options of volume,
+// they are appended to volume string after ";", e.g. eru/img:/data:rw:10G;fs=xfs,mount=noatime
+type VolumeOptions map[string]string
+
+// NewVolumeOptions parses options in format k1=v1,k2=v2
+func NewVolumeOptions(options string) (VolumeOptions, error) {
+	ans := VolumeOptions{}
+	if options == "" {
+		return ans, nil
+	}
+	for _, kv := range strings.Split(options, optionSeparator) {
+		parts := strings.SplitN(kv, optionKVSeparator, 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Wrapf(ErrInvalidVolume, "wrong option format(key=value): %s", kv)
+		}
+		if _, ok := ans[parts[0]]; ok {
+			return nil, errors.Wrapf(ErrInvalidVolume, "duplicated option: %s", parts[0])
+		}
+		ans[parts[0]] = parts[1]
+	}
+	return ans, ans.Validate()
+}
+
+// Validate returns error if there is any unknown key or invalid value
+func (opts VolumeOptions) Validate() error {
+	for key, value := range opts {
+		validate, ok := optionValidators[key]
+		if !ok {
+			return errors.Wrapf(ErrInvalidVolume, "unknown option: %s", key)
+		}
+		if value == "" || strings.ContainsAny(value, optionInvalidChars) {
+			return errors.Wrapf(ErrInvalidVolume, "invalid value of option %s: %s", key, value)
+		}
+		if validate == nil {
+			continue
+		}
+		if err := validate(value); err != nil {
+			return errors.Wrapf(ErrInvalidVolume, "invalid value of option %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// String returns options sorted by key in format k1=v1,k2=v2
+func (opts VolumeOptions) String() string {
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	kvs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, key+optionKVSeparator+opts[key])
+	}
+	return strings.Join(kvs, optionSeparator)
+}
+
+// DeepCopy .
+func (opts VolumeOptions) DeepCopy() VolumeOptions {
+	if opts == nil {
+		return nil
+	}
+	ans := VolumeOptions{}
+	for key, value := range opts {
+		ans[key] = value
+	}
+	return ans
+}
+
+// List returns the values of list option in format v1|v2
+func (opts VolumeOptions) List(key string) []string {
+	if opts[key] == "" {
+		return nil
+	}
+	return strings.Split(opts[key], optionListSeparator)
+}
+
+// Size returns the value of size option in bytes, 0 means not set
+func (opts VolumeOptions) Size(key string) int64 {
+	size, _ := utils.ParseRAMInHuman(opts[key])
+	return size
+}
+
+// Int returns the value of integer option, 0 means not set
+func (opts VolumeOptions) Int(key string) int64 {
+	n, _ := strconv.ParseInt(opts[key], 10, 64)
+	return n
+}
+
+// Merge returns the options overridden by opts1
+func (opts VolumeOptions) Merge(opts1 VolumeOptions) VolumeOptions {
+	ans := opts.DeepCopy()
+	if ans == nil && len(opts1) > 0 {
+		ans = VolumeOptions{}
+	}
+	for key, value := range opts1 {
+		ans[key] = value
+	}
+	return ans
+}
+
+func oneOf(allowed ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range allowed {
+			if v == value {
+				return nil
+			}
+		}
+		return errors.Newf("%s is not one of %v", value, allowed)
+	}
+}
+
+// listOf validates list value in format v1|v2, every item must be allowed and can't be duplicated
+func listOf(allowed ...string) func(string) error {
+	validate := oneOf(allowed...)
+	return func(value string) error {
+		seen := map[string]bool{}
+		for _, item := range strings.Split(value, optionListSeparator) {
+			if seen[item] {
+				return errors.Newf("duplicated %s", item)
+			}
+			seen[item] = true
+			if err := validate(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// validateSnapshot validates snapshot in format image@snap, the parent is never rendered so template isn't allowed
+func validateSnapshot(value string) error {
+	image, snap, ok := strings.Cut(value, snapshotSeparator)
+	if !ok || image == "" || snap == "" || strings.ContainsAny(value, "/:") || strings.Contains(snap, snapshotSeparator) {
+		return errors.Newf("wrong snapshot format(image@snap): %s", value)
+	}
+	if strings.Contains(value, "{{") {
+		return errors.Newf("snapshot can't be template: %s", value)
+	}
+	return nil
+}
+
+// validateObjectSize validates size which must be power of two between 4KiB and 32MiB
+func validateObjectSize(value string) error {
+	size, err := utils.ParseRAMInHuman(value)
+	if err != nil {
+		return err
+	}
+	if size < minObjectSize || size > maxObjectSize || size&(size-1) != 0 {
+		return errors.Newf("%s is not power of two between 4KiB and 32MiB", value)
+	}
+	return nil
+}
+
+func validateSecretRef(value string) error {
+	if !secretRefPattern.MatchString(value) {
+		return errors.New("secret reference can only contain letters, digits and ._/-")
+	}
+	return nil
+}
+
+func validatePositiveInt(value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return errors.Newf("non-positive value: %d", n)
+	}
+	return nil
+}
+
+func validateNonNegativeInt(value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return errors.Newf("negative value: %d", n)
+	}
+	return nil
+}
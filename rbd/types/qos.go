@@ -0,0 +1,90 @@
+package types
+
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/projecteru2/core/utils"
+)
+
+// QoS indicate the throughput limits of volume, 0 means unlimited
+type QoS struct {
+	ReadIOPS  int64 `json:"read_iops" mapstructure:"read_iops"`
+	WriteIOPS int64 `json:"write_iops" mapstructure:"write_iops"`
+	ReadBPS   int64 `json:"read_bps" mapstructure:"read_bps"`
+	WriteBPS  int64 `json:"write_bps" mapstructure:"write_bps"`
+}
+
+// IsZero returns true if no limit is set
+func (q *QoS) IsZero() bool {
+	return *q == QoS{}
+}
+
+// Validate .
+func (q *QoS) Validate() error {
+	for _, v := range q.fields() {
+		if *v < 0 {
+			return errors.Wrapf(ErrInvalidParams, "negative QoS: %+v", *q)
+		}
+	}
+	return nil
+}
+
+// Add .
+func (q *QoS) Add(q1 *QoS) {
+	fields1 := q1.fields()
+	for i, v := range q.fields() {
+		*v += *fields1[i]
+	}
+}
+
+// Sub .
+func (q *QoS) Sub(q1 *QoS) {
+	fields1 := q1.fields()
+	for i, v := range q.fields() {
+		*v -= *fields1[i]
+	}
+}
+
+func (q *QoS) fields() []*int64 {
+	return []*int64{&q.ReadIOPS, &q.WriteIOPS, &q.ReadBPS, &q.WriteBPS}
+}
+
+// DistributeQoS evenly distributes the budget left by the limited bindings to the unlimited ones,
+// the limits of bindings are changed in place, and 0 in budget means there is no limit to distribute.
+// Read-only bindings don't take write budget, and the bindings are kept unlimited if no budget is left.
+// It returns true if any binding is changed.
+func DistributeQoS(budget *QoS, vbs VolumeBindings) (changed bool) {
+	budgetFields := budget.fields()
+	for i, total := range budgetFields {
+		if *total <= 0 {
+			continue
+		}
+		left := *total
+		unlimited := []*int64{}
+		for _, vb := range vbs {
+			if isWriteQoS(i) && vb.IsReadOnly() {
+				continue
+			}
+			qos := vb.qosFields()
+			if *qos[i] == 0 {
+				unlimited = append(unlimited, qos[i])
+			} else {
+				left -= *qos[i]
+			}
+		}
+		if len(unlimited) == 0 || left <= 0 {
+			continue
+		}
+		// 0 means unlimited, so every binding gets 1 at least
+		share := utils.Max(left/int64(len(unlimited)), 1)
+		for _, v := range unlimited {
+			*v = share
+		}
+		changed = true
+	}
+	return changed
+}
+
+// isWriteQoS returns true if the i-th field of QoS limits writing
+func isWriteQoS(i int) bool {
+	return i == 1 || i == 3
+}
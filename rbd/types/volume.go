@@ -1,18 +1,58 @@
 package types
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"path"
 	"sort"
 	"strings"
+	"text/template"
 
 	"github.com/cockroachdb/errors"
 	"github.com/projecteru2/core/utils"
 )
 
-// VolumeBinding format =>  pool/image:dst[:flags][:size][:read_IOPS:write_IOPS:read_bytes:write_bytes]
+const (
+	// AutoImage means the image name is generated by autoImageTemplate
+	AutoImage         = "AUTO"
+	autoImageTemplate = "{{.Nodename}}-{{.Index}}-{{.Random}}"
+	randomLength      = 8
+	devicePrefix      = "/dev/"
+	clusterSeparator  = "@"
+	defaultFlags      = "rw"
+)
+
+// imageTemplateArgs are the fields can be used in image name template,
+// e.g. eru/{{.Nodename}}-{{.Index}}-{{.Random}}
+type imageTemplateArgs struct {
+	Nodename string
+	Index    int
+	Random   string
+}
+
+// ReallocAction indicates how a binding in realloc request changes the origin one
+type ReallocAction string
+
+const (
+	// ReallocResize means size and QoS are added to the origin binding, size format: [+|-]size
+	ReallocResize ReallocAction = ""
+	// ReallocSet means size, flags and QoS replace the origin ones, size format: =size,
+	// flags are replaced only if they differ from the default ones, and QoS only if the QoS positions are given
+	ReallocSet ReallocAction = "set"
+	// ReallocUpdate means flags and QoS replace the origin ones without resize, size format: =
+	ReallocUpdate ReallocAction = "update"
+)
+
+// VolumeBinding format =>  [cluster@]pool[/namespace]/image:dst[:flags][:size][:read_IOPS:write_IOPS:read_bytes:write_bytes][;key=value,...]
+// image in format image@snap means cloning the snapshot to a new image named by AUTO template, the snapshot is kept in parent option,
+// and the size of clone must be given since it is accounted instead of the size of parent
+// flags: r(read), w(write), m(monitor), o(only), s(shared by replicas), f(force shrink in realloc request),
+// b(raw block device, the destination is a device path in workload)
 type VolumeBinding struct {
+	Cluster     string `json:"cluster" mapstructure:"cluster"` // ceph cluster declared in config, empty means the default cluster
 	Pool        string `json:"pool" mapstructure:"pool"`
+	Namespace   string `json:"namespace" mapstructure:"namespace"` // RADOS namespace, empty means the default namespace
 	Image       string `json:"image" mapstructure:"image"`
 	Destination string `json:"destination" mapstructure:"destination"`
 	Flags       string `json:"flags" mapstructure:"flags"`
@@ -21,19 +61,182 @@ type VolumeBinding struct {
 	WriteIOPS   int64  `json:"write_iops" mapstructure:"write_iops"`
 	ReadBPS     int64  `json:"read_bps" mapstructure:"read_bps"`
 	WriteBPS    int64  `json:"write_bps" mapstructure:"write_bps"`
+	// Options are the key=value options after ";"
+	Options VolumeOptions `json:"options,omitempty" mapstructure:"options"`
+
+	// Action is only used by realloc request
+	Action ReallocAction `json:"-" mapstructure:"-"`
+	// hasQoS indicates whether the QoS positions are given in volume string
+	hasQoS bool
 }
 
+// GetSource returns the image in format [cluster@]pool[/namespace]/image
 func (vb *VolumeBinding) GetSource() string {
-	return fmt.Sprintf("%s/%s", vb.Pool, vb.Image)
+	if vb.Cluster == "" {
+		return vb.GetImageSpec()
+	}
+	return vb.Cluster + clusterSeparator + vb.GetImageSpec()
+}
+
+// GetImageSpec returns the image spec used by rbd command in format pool[/namespace]/image
+func (vb *VolumeBinding) GetImageSpec() string {
+	if vb.Namespace == "" {
+		return fmt.Sprintf("%s/%s", vb.Pool, vb.Image)
+	}
+	return fmt.Sprintf("%s/%s/%s", vb.Pool, vb.Namespace, vb.Image)
+}
+
+// GetPoolKey returns the key of pool in capacity, in format [cluster@]pool
+func (vb *VolumeBinding) GetPoolKey() string {
+	if vb.Cluster == "" {
+		return vb.Pool
+	}
+	return vb.Cluster + clusterSeparator + vb.Pool
+}
+
+func (vb *VolumeBinding) GetMapKey() [4]string {
+	return [4]string{vb.GetPoolKey(), vb.Namespace, vb.Image, vb.Destination}
+}
+
+// IsShared returns true if the image is allowed to be shared by replicas
+func (vb *VolumeBinding) IsShared() bool {
+	return strings.Contains(vb.Flags, "s")
+}
+
+// hasFlags returns true if the flags are given and differ from the default ones, force shrink flag is ignored
+func (vb *VolumeBinding) hasFlags() bool {
+	flags := strings.ReplaceAll(vb.Flags, "f", "")
+	return flags != "" && flags != defaultFlags
+}
+
+// AllowShrink returns true if the realloc request is allowed to shrink the volume
+func (vb *VolumeBinding) AllowShrink() bool {
+	return strings.Contains(vb.Flags, "f")
+}
+
+func (vb *VolumeBinding) qosFields() []*int64 {
+	return []*int64{&vb.ReadIOPS, &vb.WriteIOPS, &vb.ReadBPS, &vb.WriteBPS}
+}
+
+// GetParent returns the snapshot cloned by volume in format pool[/namespace]/image@snap, empty means the volume isn't a clone
+func (vb *VolumeBinding) GetParent() string {
+	parent := vb.Options["parent"]
+	if parent == "" {
+		return ""
+	}
+	if vb.Namespace == "" {
+		return fmt.Sprintf("%s/%s", vb.Pool, parent)
+	}
+	return fmt.Sprintf("%s/%s/%s", vb.Pool, vb.Namespace, parent)
+}
+
+// IsBlock returns true if the device is passed through to workload without filesystem
+func (vb *VolumeBinding) IsBlock() bool {
+	return strings.Contains(vb.Flags, "b")
+}
+
+// FS returns the filesystem type of volume, empty means it is decided by engine
+func (vb *VolumeBinding) FS() string {
+	return vb.Options["fs"]
+}
+
+// MkfsOptions .
+func (vb *VolumeBinding) MkfsOptions() []string {
+	return vb.Options.List("mkfs")
 }
 
-func (vb *VolumeBinding) GetMapKey() [3]string {
-	return [3]string{vb.Pool, vb.Image, vb.Destination}
+// MountOptions .
+func (vb *VolumeBinding) MountOptions() []string {
+	return vb.Options.List("mount")
+}
+
+// Features returns the features enabled when creating image, empty means they are decided by engine
+func (vb *VolumeBinding) Features() []string {
+	return vb.Options.List("features")
+}
+
+// ObjectSize returns the object size of image in bytes, 0 means default
+func (vb *VolumeBinding) ObjectSize() int64 {
+	return vb.Options.Size("object_size")
+}
+
+// StripeUnit returns the stripe unit of image in bytes, 0 means default
+func (vb *VolumeBinding) StripeUnit() int64 {
+	return vb.Options.Size("stripe_unit")
+}
+
+// StripeCount returns the stripe count of image, 0 means default
+func (vb *VolumeBinding) StripeCount() int64 {
+	return vb.Options.Int("stripe_count")
+}
+
+// hasLayoutOption returns true if any image layout option is given
+func (vb *VolumeBinding) hasLayoutOption() bool {
+	for _, key := range imageLayoutOptions {
+		if _, ok := vb.Options[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Encryption returns the LUKS format of image, empty means the image isn't encrypted
+func (vb *VolumeBinding) Encryption() string {
+	return vb.Options["encryption"]
+}
+
+// EncryptionSecret returns the reference of passphrase secret
+func (vb *VolumeBinding) EncryptionSecret() string {
+	return vb.Options["encryption_secret"]
+}
+
+// IsReadOnly .
+func (vb *VolumeBinding) IsReadOnly() bool {
+	return !strings.Contains(vb.Flags, "w")
+}
+
+// IsImageTemplate returns true if the image name should be rendered for every replica
+func (vb *VolumeBinding) IsImageTemplate() bool {
+	return vb.Image == AutoImage || strings.Contains(vb.Image, "{{")
+}
+
+// RenderImage returns the image name of the index-th replica on node
+func (vb *VolumeBinding) RenderImage(nodename string, index int) (string, error) {
+	if !vb.IsImageTemplate() {
+		return vb.Image, nil
+	}
+	return vb.renderImage(imageTemplateArgs{
+		Nodename: nodename,
+		Index:    index,
+		Random:   strings.ToLower(utils.RandomString(randomLength)),
+	})
+}
+
+func (vb *VolumeBinding) renderImage(args imageTemplateArgs) (string, error) {
+	text := vb.Image
+	if text == AutoImage {
+		text = autoImageTemplate
+	}
+	tmpl, err := template.New("image").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(ErrInvalidVolume, "invalid image template %s: %s", vb.Image, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, args); err != nil {
+		return "", errors.Wrapf(ErrInvalidVolume, "failed to render image template %s: %s", vb.Image, err)
+	}
+	image := buf.String()
+	if image == "" || strings.ContainsAny(image, "/:") {
+		return "", errors.Wrapf(ErrInvalidVolume, "invalid image name rendered by %s: %s", vb.Image, image)
+	}
+	return image, nil
 }
 
 func (vb *VolumeBinding) DeepCopy() *VolumeBinding {
 	return &VolumeBinding{
+		Cluster:     vb.Cluster,
 		Pool:        vb.Pool,
+		Namespace:   vb.Namespace,
 		Image:       vb.Image,
 		Destination: vb.Destination,
 		Flags:       vb.Flags,
@@ -42,6 +245,9 @@ func (vb *VolumeBinding) DeepCopy() *VolumeBinding {
 		WriteIOPS:   vb.WriteIOPS,
 		ReadBPS:     vb.ReadBPS,
 		WriteBPS:    vb.WriteBPS,
+		Options:     vb.Options.DeepCopy(),
+		Action:      vb.Action,
+		hasQoS:      vb.hasQoS,
 	}
 }
 
@@ -50,12 +256,22 @@ func NewVolumeBinding(volume string) (_ *VolumeBinding, err error) {
 	var src, dst, flags string
 	var size, readIOPS, writeIOPS, readBPS, writeBPS int64
 
-	parts := strings.Split(volume, ":")
+	positional, rawOptions, hasOptions := strings.Cut(volume, optionsSeparator)
+	if hasOptions && rawOptions == "" {
+		return nil, errors.Wrapf(ErrInvalidVolume, "empty options: %s", volume)
+	}
+	options, err := NewVolumeOptions(rawOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(positional, ":")
 	if len(parts) > 8 || len(parts) < 2 {
 		return nil, errors.Wrap(ErrInvalidVolume, volume)
 	}
+	hasQoS := len(parts) > 4
 	if len(parts) == 2 {
-		parts = append(parts, "rw")
+		parts = append(parts, defaultFlags)
 	}
 	for len(parts) < 8 {
 		parts = append(parts, "0")
@@ -64,6 +280,15 @@ func NewVolumeBinding(volume string) (_ *VolumeBinding, err error) {
 	dst = parts[1]
 	flags = parts[2]
 
+	var action ReallocAction
+	if strings.HasPrefix(parts[3], "=") {
+		parts[3] = strings.TrimPrefix(parts[3], "=")
+		action = ReallocSet
+		if parts[3] == "" {
+			action = ReallocUpdate
+		}
+	}
+
 	ptrs := []*int64{&size, &readIOPS, &writeIOPS, &readBPS, &writeBPS}
 	for i, ptr := range ptrs {
 		value, err := utils.ParseRAMInHuman(parts[i+3])
@@ -76,13 +301,36 @@ func NewVolumeBinding(volume string) (_ *VolumeBinding, err error) {
 	flagParts := strings.Split(flags, "")
 	sort.Strings(flagParts)
 
-	srcParts := strings.Split(src, "/")
-	if len(srcParts) != 2 {
-		return nil, errors.Wrapf(ErrInvalidVolume, "wrong source format(pool/image): %s", volume)
+	var cluster, pool, namespace, image string
+	if idx := strings.Index(src, clusterSeparator); idx >= 0 && !strings.Contains(src[:idx], "/") {
+		cluster, src = src[:idx], src[idx+1:]
+		if cluster == "" {
+			return nil, errors.Wrapf(ErrInvalidVolume, "empty cluster: %s", volume)
+		}
+	}
+	switch srcParts := strings.Split(src, "/"); len(srcParts) {
+	case 2:
+		pool, image = srcParts[0], srcParts[1]
+	case 3:
+		pool, namespace, image = srcParts[0], srcParts[1], srcParts[2]
+		if namespace == "" {
+			return nil, errors.Wrapf(ErrInvalidVolume, "empty namespace: %s", volume)
+		}
+	default:
+		return nil, errors.Wrapf(ErrInvalidVolume, "wrong source format(pool[/namespace]/image): %s", volume)
+	}
+	// clone from snapshot
+	if strings.Contains(image, snapshotSeparator) {
+		if _, ok := options["parent"]; ok {
+			return nil, errors.Wrapf(ErrInvalidVolume, "parent is set twice: %s", volume)
+		}
+		options["parent"] = image
+		image = AutoImage
 	}
-	pool, image := srcParts[0], srcParts[1]
 	vb := &VolumeBinding{
+		Cluster:     cluster,
 		Pool:        pool,
+		Namespace:   namespace,
 		Image:       image,
 		Destination: dst,
 		Flags:       strings.Join(flagParts, ""),
@@ -91,10 +339,15 @@ func NewVolumeBinding(volume string) (_ *VolumeBinding, err error) {
 		WriteIOPS:   writeIOPS,
 		ReadBPS:     readBPS,
 		WriteBPS:    writeBPS,
+		Action:      action,
+		hasQoS:      hasQoS,
+	}
+	if len(options) > 0 {
+		vb.Options = options
 	}
 
 	if vb.Flags == "" {
-		vb.Flags = "rw"
+		vb.Flags = defaultFlags
 	}
 
 	return vb, vb.Validate()
@@ -110,14 +363,96 @@ func (vb VolumeBinding) Validate() error {
 	if vb.Pool == "" || vb.Image == "" {
 		return errors.Wrapf(ErrInvalidVolume, "pool and image must be provided: %+v", vb)
 	}
+	if strings.Contains(vb.Namespace, "/") {
+		return errors.Wrapf(ErrInvalidVolume, "invalid namespace: %+v", vb)
+	}
+	if strings.ContainsAny(vb.Cluster, "/@") {
+		return errors.Wrapf(ErrInvalidVolume, "invalid cluster: %+v", vb)
+	}
+	if err := vb.Options.Validate(); err != nil {
+		return err
+	}
+	if vb.IsBlock() {
+		if !strings.HasPrefix(vb.Destination, devicePrefix) || len(vb.Destination) == len(devicePrefix) || path.Clean(vb.Destination) != vb.Destination {
+			return errors.Wrapf(ErrInvalidVolume, "dest of block volume must be a device path like /dev/rbd0: %+v", vb)
+		}
+		if (vb.FS() != "" && vb.FS() != FSNone) || vb.MkfsOptions() != nil || vb.MountOptions() != nil {
+			return errors.Wrapf(ErrInvalidVolume, "block volume can't have filesystem: %+v", vb)
+		}
+	}
+	switch {
+	case vb.FS() == FSNone && (vb.MkfsOptions() != nil || vb.MountOptions() != nil):
+		return errors.Wrapf(ErrInvalidVolume, "volume without filesystem can't have mkfs or mount options: %+v", vb)
+	case vb.FS() == "" && vb.MkfsOptions() != nil:
+		return errors.Wrapf(ErrInvalidVolume, "fs must be provided with mkfs options: %+v", vb)
+	}
+	if err := vb.validateImageOptions(); err != nil {
+		return err
+	}
+	if vb.Action == ReallocSet && vb.SizeInBytes <= 0 {
+		return errors.Wrapf(ErrInvalidVolume, "absolute size must be positive, use detach to remove volume: %+v", vb)
+	}
+	if vb.IsImageTemplate() {
+		if vb.IsShared() {
+			return errors.Wrapf(ErrInvalidVolume, "shared volume can't use image template: %+v", vb)
+		}
+		if _, err := vb.renderImage(imageTemplateArgs{Nodename: "node", Random: "random"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vb VolumeBinding) validateImageOptions() error {
+	features := map[string]bool{}
+	for _, feature := range vb.Features() {
+		features[feature] = true
+	}
+	for _, feature := range vb.Features() {
+		if dep, ok := featureDependencies[feature]; ok && !features[dep] {
+			return errors.Wrapf(ErrInvalidVolume, "feature %s requires %s: %+v", feature, dep, vb)
+		}
+	}
+	if vb.GetParent() != "" && len(features) > 0 && !features[featureLayering] {
+		return errors.Wrapf(ErrInvalidVolume, "clone requires feature %s: %+v", featureLayering, vb)
+	}
+	if (vb.Encryption() == "") != (vb.EncryptionSecret() == "") {
+		return errors.Wrapf(ErrInvalidVolume, "encryption and encryption_secret must be provided together: %+v", vb)
+	}
+	if vb.Encryption() != "" {
+		switch {
+		case vb.GetParent() != "":
+			return errors.Wrapf(ErrInvalidVolume, "clone can't be encrypted: %+v", vb)
+		case features[featureJournaling]:
+			return errors.Wrapf(ErrInvalidVolume, "encrypted volume can't enable %s: %+v", featureJournaling, vb)
+		}
+	}
+	if (vb.StripeUnit() == 0) != (vb.StripeCount() == 0) {
+		return errors.Wrapf(ErrInvalidVolume, "stripe_unit and stripe_count must be provided together: %+v", vb)
+	}
+	objectSize := vb.ObjectSize()
+	if objectSize == 0 {
+		objectSize = defaultObjectSize
+	}
+	if vb.StripeUnit() > objectSize {
+		return errors.Wrapf(ErrInvalidVolume, "stripe_unit can't be larger than object size: %+v", vb)
+	}
 	return nil
 }
 
+// normalizedFlags returns the flags without the ones only used by plugin
+func (vb VolumeBinding) normalizedFlags() string {
+	flags := strings.ReplaceAll(vb.Flags, "m", "")
+	flags = strings.ReplaceAll(flags, "s", "")
+	flags = strings.ReplaceAll(flags, "f", "")
+	return strings.ReplaceAll(flags, "b", "")
+}
+
 // ToString returns volume string
 func (vb VolumeBinding) ToString(normalize bool) (volume string) {
 	flags := vb.Flags
 	if normalize {
-		flags = strings.ReplaceAll(flags, "m", "")
+		flags = vb.normalizedFlags()
 	}
 
 	if strings.Contains(flags, "o") {
@@ -125,7 +460,7 @@ func (vb VolumeBinding) ToString(normalize bool) (volume string) {
 		flags = strings.ReplaceAll(flags, "r", "ro")
 		flags = strings.ReplaceAll(flags, "w", "wo")
 	}
-	src := fmt.Sprintf("%s/%s", vb.Pool, vb.Image)
+	src := vb.GetSource()
 	if !normalize {
 		volume = fmt.Sprintf("%s:%s:%s:%d:%d:%d:%d:%d", src, vb.Destination, flags, vb.SizeInBytes, vb.ReadIOPS, vb.WriteIOPS, vb.ReadBPS, vb.WriteBPS)
 	} else {
@@ -138,6 +473,9 @@ func (vb VolumeBinding) ToString(normalize bool) (volume string) {
 			volume = fmt.Sprintf("%s:%s:%s:%d", src, vb.Destination, flags, vb.SizeInBytes)
 		}
 	}
+	if len(vb.Options) > 0 {
+		volume += optionsSeparator + vb.Options.String()
+	}
 	return volume
 }
 
@@ -147,7 +485,7 @@ func (vbs VolumeBindings) Equal(vbs1 VolumeBindings) bool {
 	if len(vbs) != len(vbs1) {
 		return false
 	}
-	seen := map[[3]string]*VolumeBinding{}
+	seen := map[[4]string]*VolumeBinding{}
 	for _, vb := range vbs {
 		seen[vb.GetMapKey()] = vb
 	}
@@ -156,7 +494,7 @@ func (vbs VolumeBindings) Equal(vbs1 VolumeBindings) bool {
 		if !ok {
 			return false
 		}
-		if *vb != *vb1 {
+		if vb.ToString(false) != vb1.ToString(false) || vb.Action != vb1.Action {
 			return false
 		}
 	}
@@ -170,6 +508,24 @@ func (vbs VolumeBindings) TotalSize() int64 {
 	return ans
 }
 
+// PoolSizes returns the total size of bindings in every pool, the key is [cluster@]pool
+func (vbs VolumeBindings) PoolSizes() PoolMap {
+	ans := PoolMap{}
+	for _, vb := range vbs {
+		ans[vb.GetPoolKey()] += vb.SizeInBytes
+	}
+	return ans
+}
+
+// QoS returns the total QoS reserved by bindings
+func (vbs VolumeBindings) QoS() *QoS {
+	ans := &QoS{}
+	for _, vb := range vbs {
+		ans.Add(&QoS{ReadIOPS: vb.ReadIOPS, WriteIOPS: vb.WriteIOPS, ReadBPS: vb.ReadBPS, WriteBPS: vb.WriteBPS})
+	}
+	return ans
+}
+
 func (vbs *VolumeBindings) UnmarshalJSON(b []byte) (err error) {
 	volumes := []string{}
 	if err = json.Unmarshal(b, &volumes); err != nil {
@@ -215,6 +571,10 @@ func (vbs VolumeBindings) Validate() error {
 		}
 		seenDest[vb.Destination] = true
 
+		// image templates are rendered to different images
+		if vb.IsImageTemplate() {
+			continue
+		}
 		src := vb.GetSource()
 		if v := seenSrc[src]; v {
 			if vb.Image != "" {
@@ -226,9 +586,32 @@ func (vbs VolumeBindings) Validate() error {
 	return nil
 }
 
-// MergeVolumeBindings combines two VolumeBindings
+// validateNoAction returns error if any binding has absolute size, which is only used by realloc request
+func (vbs VolumeBindings) validateNoAction() error {
+	for _, vb := range vbs {
+		if vb.Action != ReallocResize {
+			return errors.Wrapf(ErrInvalidVolume, "absolute size is only allowed in realloc request: %s", vb.ToString(false))
+		}
+	}
+	return nil
+}
+
+// MergeVolumeBindings combines two VolumeBindings,
+// the order of bindings in vbs2 is kept and the new bindings in vbs1 are appended after them.
+// The bindings without positive size are removed.
 func MergeVolumeBindings(vbs1 VolumeBindings, vbs2 ...VolumeBindings) (ans VolumeBindings) {
-	vbMap := map[[3]string]*VolumeBinding{}
+	for _, vb := range mergeVolumeBindings(vbs1, vbs2...) {
+		if vb.SizeInBytes > 0 {
+			ans = append(ans, vb)
+		}
+	}
+	return ans
+}
+
+// mergeVolumeBindings combines two VolumeBindings like MergeVolumeBindings, but keeps all the bindings
+func mergeVolumeBindings(vbs1 VolumeBindings, vbs2 ...VolumeBindings) VolumeBindings {
+	vbMap := map[[4]string]*VolumeBinding{}
+	merged := VolumeBindings{}
 	for _, vbs := range append(vbs2, vbs1) {
 		for _, vb := range vbs {
 			if binding, ok := vbMap[vb.GetMapKey()]; ok {
@@ -238,27 +621,13 @@ func MergeVolumeBindings(vbs1 VolumeBindings, vbs2 ...VolumeBindings) (ans Volum
 				binding.ReadBPS += vb.ReadBPS
 				binding.WriteBPS += vb.WriteBPS
 			} else {
-				vbMap[vb.GetMapKey()] = &VolumeBinding{
-					Pool:        vb.Pool,
-					Image:       vb.Image,
-					Destination: vb.Destination,
-					Flags:       vb.Flags,
-					SizeInBytes: vb.SizeInBytes,
-					ReadIOPS:    vb.ReadIOPS,
-					WriteIOPS:   vb.WriteIOPS,
-					ReadBPS:     vb.ReadBPS,
-					WriteBPS:    vb.WriteBPS,
-				}
+				binding = vb.DeepCopy()
+				vbMap[vb.GetMapKey()] = binding
+				merged = append(merged, binding)
 			}
 		}
 	}
-
-	for _, vb := range vbMap {
-		if vb.SizeInBytes > 0 {
-			ans = append(ans, vb)
-		}
-	}
-	return ans
+	return merged
 }
 
 func RemoveEmptyVolumeBinding(vbs VolumeBindings) VolumeBindings {
@@ -0,0 +1,297 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/docker/go-units"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeVolumeBindings(t *testing.T) {
+	origin, err := NewVolumeBindings([]string{
+		"eru/img3:/dir3:rw:1GiB",
+		"eru/img1:/dir1:rw:1GiB",
+		"eru/img2:/dir2:rw:1GiB",
+		"eru/img0:/dir0:rw:1GiB",
+	})
+	assert.NoError(t, err)
+	req, err := NewVolumeBindings([]string{
+		"eru/img5:/dir5:rw:1GiB",
+		"eru/img2:/dir2:rw:-1GiB",
+		"eru/img0:/dir0:rw:1GiB",
+		"eru/img4:/dir4:rw:1GiB",
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		vbs := MergeVolumeBindings(req, origin)
+		sources := []string{}
+		for _, vb := range vbs {
+			sources = append(sources, vb.GetSource())
+		}
+		assert.Equal(t, []string{"eru/img3", "eru/img1", "eru/img0", "eru/img5", "eru/img4"}, sources)
+		assert.Equal(t, int64(2<<30), vbs[2].SizeInBytes)
+	}
+	// origin is not changed
+	assert.Equal(t, int64(1<<30), origin[3].SizeInBytes)
+}
+
+func TestVolumeBindingOptions(t *testing.T) {
+	// legacy strings are not changed
+	vb, err := NewVolumeBinding("eru/img0:/dir0:rw:1024:1:2:3:4")
+	assert.NoError(t, err)
+	assert.Nil(t, vb.Options)
+	assert.Equal(t, "eru/img0:/dir0:rw:1024:1:2:3:4", vb.ToString(false))
+
+	vb, err = NewVolumeBinding("eru/img0:/dir0:rw:1GiB;mount=noatime,iops_burst=2000,fs=xfs")
+	assert.NoError(t, err)
+	assert.Equal(t, VolumeOptions{"fs": "xfs", "mount": "noatime", "iops_burst": "2000"}, vb.Options)
+	assert.Equal(t, int64(1<<30), vb.SizeInBytes)
+	assert.Equal(t, "eru/img0:/dir0:rw:1073741824;fs=xfs,iops_burst=2000,mount=noatime", vb.ToString(true))
+
+	// round trip
+	vb1, err := NewVolumeBinding(vb.ToString(false))
+	assert.NoError(t, err)
+	assert.True(t, VolumeBindings{vb}.Equal(VolumeBindings{vb1}))
+	assert.Equal(t, vb.ToString(false), vb1.ToString(false))
+	vb1 = vb.DeepCopy()
+	vb1.Options["fs"] = "ext4"
+	assert.Equal(t, "xfs", vb.Options["fs"])
+
+	for _, volume := range []string{
+		"eru/img0:/dir0:rw:1GiB;",
+		"eru/img0:/dir0:rw:1GiB;unknown=1",
+		"eru/img0:/dir0:rw:1GiB;fs",
+		"eru/img0:/dir0:rw:1GiB;fs=",
+		"eru/img0:/dir0:rw:1GiB;fs=xfs,fs=ext4",
+		"eru/img0:/dir0:rw:1GiB;fs=xfs,",
+		"eru/img0:/dir0:rw:1GiB;iops_burst=-1",
+		"eru/img0:/dir0:rw:1GiB;iops_burst=abc",
+	} {
+		_, err = NewVolumeBinding(volume)
+		assert.ErrorIs(t, err, ErrInvalidVolume, volume)
+	}
+}
+
+func TestVolumeBindingFilesystem(t *testing.T) {
+	vb, err := NewVolumeBinding("eru/img0:/dir0:rw:1GiB;fs=ext4,mkfs=nodiscard|lazy_itable_init,mount=noatime|discard")
+	assert.NoError(t, err)
+	assert.Equal(t, "ext4", vb.FS())
+	assert.Equal(t, []string{"nodiscard", "lazy_itable_init"}, vb.MkfsOptions())
+	assert.Equal(t, []string{"noatime", "discard"}, vb.MountOptions())
+
+	vb, err = NewVolumeBinding("eru/img0:/dir0:rw:1GiB;mount=noatime")
+	assert.NoError(t, err)
+	assert.Empty(t, vb.FS())
+	assert.Nil(t, vb.MkfsOptions())
+
+	for _, volume := range []string{
+		"eru/img0:/dir0:rw:1GiB;fs=btrfs",
+		"eru/img0:/dir0:rw:1GiB;fs=xfs,mkfs=-m 0",
+		"eru/img0:/dir0:rw:1GiB;fs=xfs,mount=noatime|noatime",
+		"eru/img0:/dir0:rw:1GiB;fs=xfs,mount=noatime|",
+		"eru/img0:/dir0:rw:1GiB;fs=none,mount=noatime",
+		"eru/img0:/dir0:rw:1GiB;mkfs=nodiscard",
+	} {
+		_, err = NewVolumeBinding(volume)
+		assert.ErrorIs(t, err, ErrInvalidVolume, volume)
+	}
+}
+
+func TestVolumeBindingBlock(t *testing.T) {
+	vb, err := NewVolumeBinding("eru/img0:/dev/vdb:rwb:1GiB")
+	assert.NoError(t, err)
+	assert.True(t, vb.IsBlock())
+	assert.Equal(t, "brw", vb.Flags)
+	assert.Equal(t, "eru/img0:/dev/vdb:rw:1073741824", vb.ToString(true))
+	assert.Equal(t, "eru/img0:/dev/vdb:brw:1073741824:0:0:0:0", vb.ToString(false))
+	_, err = NewVolumeBinding("eru/img0:/dev/vdb:rwb:1GiB;fs=none")
+	assert.NoError(t, err)
+
+	for _, volume := range []string{
+		"eru/img0:/data:rwb:1GiB",
+		"eru/img0:/dev/:rwb:1GiB",
+		"eru/img0:/dev/../data:rwb:1GiB",
+		"eru/img0:/dev/vdb/:rwb:1GiB",
+		"eru/img0:/dev/vdb:rwb:1GiB;fs=xfs",
+		"eru/img0:/dev/vdb:rwb:1GiB;mount=noatime",
+	} {
+		_, err = NewVolumeBinding(volume)
+		assert.ErrorIs(t, err, ErrInvalidVolume, volume)
+	}
+
+	// block mode can't be changed by realloc
+	origin, err := NewVolumeBindings([]string{"eru/img0:/dev/vdb:rwb:1GiB"})
+	assert.NoError(t, err)
+	req := &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(map[string]any{"volumes": []string{"eru/img0:/dev/vdb:rw:="}}))
+	_, err = req.ApplyTo(origin)
+	assert.ErrorIs(t, err, ErrInvalidVolumes)
+}
+
+func TestVolumeBindingNamespace(t *testing.T) {
+	vb, err := NewVolumeBinding("eru/tenant1/img0:/dir0:rw:1GiB")
+	assert.NoError(t, err)
+	assert.Equal(t, "eru", vb.Pool)
+	assert.Equal(t, "tenant1", vb.Namespace)
+	assert.Equal(t, "img0", vb.Image)
+	assert.Equal(t, "eru/tenant1/img0", vb.GetSource())
+	assert.Equal(t, "eru/tenant1/img0:/dir0:rw:1073741824", vb.ToString(true))
+	vb1, err := NewVolumeBinding(vb.ToString(false))
+	assert.NoError(t, err)
+	assert.Equal(t, vb.GetMapKey(), vb1.GetMapKey())
+
+	// the same image in different namespaces
+	vbs, err := NewVolumeBindings([]string{
+		"eru/img0:/dir0:rw:1GiB",
+		"eru/tenant1/img0:/dir1:rw:1GiB",
+		"eru/tenant2/img0:/dir2:rw:1GiB",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, vbs.Validate())
+	assert.NotEqual(t, vbs[0].GetMapKey(), vbs[1].GetMapKey())
+	vbs, err = NewVolumeBindings([]string{
+		"eru/tenant1/img0:/dir0:rw:1GiB",
+		"eru/tenant1/img0:/dir1:rw:1GiB",
+	})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, vbs.Validate(), ErrInvalidVolumes)
+
+	for _, volume := range []string{
+		"eru//img0:/dir0:rw:1GiB",
+		"eru/a/b/img0:/dir0:rw:1GiB",
+		"eru/tenant1/:/dir0:rw:1GiB",
+	} {
+		_, err = NewVolumeBinding(volume)
+		assert.ErrorIs(t, err, ErrInvalidVolume, volume)
+	}
+}
+
+func TestVolumeBindingCluster(t *testing.T) {
+	vb, err := NewVolumeBinding("c1@eru/img0:/dir0:rw:1GiB")
+	assert.NoError(t, err)
+	assert.Equal(t, "c1", vb.Cluster)
+	assert.Equal(t, "c1@eru/img0", vb.GetSource())
+	assert.Equal(t, "eru/img0", vb.GetImageSpec())
+	assert.Equal(t, "c1@eru", vb.GetPoolKey())
+	assert.Equal(t, "c1@eru/img0:/dir0:rw:1073741824", vb.ToString(true))
+
+	// the same image in different clusters
+	vbs, err := NewVolumeBindings([]string{"c1@eru/img0:/dir0:rw:1GiB", "eru/img0:/dir1:rw:1GiB"})
+	assert.NoError(t, err)
+	assert.NoError(t, vbs.Validate())
+	assert.NotEqual(t, vbs[0].GetMapKey(), vbs[1].GetMapKey())
+
+	_, err = NewVolumeBinding("@eru/img0:/dir0:rw:1GiB")
+	assert.ErrorIs(t, err, ErrInvalidVolume)
+}
+
+func TestVolumeBindingClone(t *testing.T) {
+	vb, err := NewVolumeBinding("c1@eru/ns/golden@v1:/dir0:rw:1GiB")
+	assert.NoError(t, err)
+	assert.NoError(t, vb.Validate())
+	assert.Equal(t, "c1", vb.Cluster)
+	assert.Equal(t, AutoImage, vb.Image)
+	assert.True(t, vb.IsImageTemplate())
+	assert.Equal(t, "eru/ns/golden@v1", vb.GetParent())
+
+	// the rendered clone keeps its parent
+	vb1 := vb.DeepCopy()
+	vb1.Image, err = vb1.RenderImage("node1", 0)
+	assert.NoError(t, err)
+	vb2, err := NewVolumeBinding(vb1.ToString(false))
+	assert.NoError(t, err)
+	assert.Equal(t, vb1.Image, vb2.Image)
+	assert.Equal(t, "eru/ns/golden@v1", vb2.GetParent())
+
+	// clone with explicit name
+	vb, err = NewVolumeBinding("eru/img0:/dir0:rw:1GiB;parent=golden@v1")
+	assert.NoError(t, err)
+	assert.NoError(t, vb.Validate())
+	assert.Equal(t, "eru/golden@v1", vb.GetParent())
+
+	vb, err = NewVolumeBinding("eru/img0:/dir0:rw:1GiB")
+	assert.NoError(t, err)
+	assert.Empty(t, vb.GetParent())
+
+	for _, s := range []string{
+		"eru/golden@:/dir0:rw:1GiB",
+		"eru/@v1:/dir0:rw:1GiB",
+		"eru/golden@v1@v2:/dir0:rw:1GiB",
+		"eru/golden@v1:/dir0:rw:1GiB;parent=golden@v2",
+		"eru/img0:/dir0:rw:1GiB;parent=golden",
+		"eru/{{.Nodename}}@snap:/dir0:rw:1GiB",
+		"eru/golden@{{.Index}}:/dir0:rw:1GiB",
+	} {
+		vb, err := NewVolumeBinding(s)
+		if err == nil {
+			err = vb.Validate()
+		}
+		assert.Error(t, err, s)
+	}
+}
+
+func TestVolumeBindingImageOptions(t *testing.T) {
+	vb, err := NewVolumeBinding("eru/img0:/dir0:rw:1GiB;features=layering|exclusive-lock|object-map,object_size=8MiB,stripe_unit=64KiB,stripe_count=16")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"layering", "exclusive-lock", "object-map"}, vb.Features())
+	assert.Equal(t, int64(8*units.MiB), vb.ObjectSize())
+	assert.Equal(t, int64(64*units.KiB), vb.StripeUnit())
+	assert.Equal(t, int64(16), vb.StripeCount())
+	params := NewVolumeParams(vb)
+	assert.Equal(t, vb.Features(), params.Features)
+	assert.Equal(t, int64(8*units.MiB), params.ObjectSize)
+
+	vb, err = NewVolumeBinding("eru/img0:/dir0:rw:1GiB")
+	assert.NoError(t, err)
+	assert.Nil(t, vb.Features())
+	assert.Zero(t, vb.ObjectSize())
+
+	for _, s := range []string{
+		"eru/img0:/dir0:rw:1GiB;features=deep-flatten",
+		"eru/img0:/dir0:rw:1GiB;features=layering|layering",
+		"eru/img0:/dir0:rw:1GiB;features=object-map",
+		"eru/img0:/dir0:rw:1GiB;features=exclusive-lock|fast-diff",
+		"eru/img0:/dir0:rw:1GiB;features=journaling",
+		"eru/golden@v1:/dir0:rw:1GiB;features=exclusive-lock",
+		"eru/img0:/dir0:rw:1GiB;object_size=3MiB",
+		"eru/img0:/dir0:rw:1GiB;object_size=64MiB",
+		"eru/img0:/dir0:rw:1GiB;object_size=1KiB",
+		"eru/img0:/dir0:rw:1GiB;stripe_unit=64KiB",
+		"eru/img0:/dir0:rw:1GiB;stripe_count=0",
+		"eru/img0:/dir0:rw:1GiB;stripe_unit=8MiB,stripe_count=2",
+		"eru/img0:/dir0:rw:1GiB;object_size=64KiB,stripe_unit=128KiB,stripe_count=2",
+	} {
+		_, err := NewVolumeBinding(s)
+		assert.ErrorIs(t, err, ErrInvalidVolume, s)
+	}
+}
+
+func TestVolumeBindingEncryption(t *testing.T) {
+	vb, err := NewVolumeBinding("eru/img0:/dir0:rw:1GiB;encryption=luks2,encryption_secret=ns/img0-passphrase")
+	assert.NoError(t, err)
+	assert.Equal(t, "luks2", vb.Encryption())
+	assert.Equal(t, "ns/img0-passphrase", vb.EncryptionSecret())
+	assert.Equal(t, "eru/img0:/dir0:rw:1073741824;encryption=luks2,encryption_secret=ns/img0-passphrase", vb.ToString(true))
+
+	// engine gets the reference only
+	ep := &EngineParams{}
+	ep.AddVolume(vb)
+	raw := ep.AsRawParams()
+	params := raw["volumes_params"].([]*VolumeParams)
+	assert.Equal(t, "luks2", params[0].Encryption)
+	assert.Equal(t, "ns/img0-passphrase", params[0].EncryptionSecret)
+
+	for _, s := range []string{
+		"eru/img0:/dir0:rw:1GiB;encryption=luks2",
+		"eru/img0:/dir0:rw:1GiB;encryption_secret=img0-passphrase",
+		"eru/img0:/dir0:rw:1GiB;encryption=aes,encryption_secret=img0-passphrase",
+		"eru/img0:/dir0:rw:1GiB;encryption=luks1,encryption_secret=pass word",
+		"eru/img0:/dir0:rw:1GiB;encryption=luks1,passphrase=123456",
+		"eru/golden@v1:/dir0:rw:1GiB;encryption=luks2,encryption_secret=img0-passphrase",
+		"eru/img0:/dir0:rw:1GiB;encryption=luks2,encryption_secret=img0-passphrase,features=layering|exclusive-lock|journaling",
+	} {
+		_, err := NewVolumeBinding(s)
+		assert.ErrorIs(t, err, ErrInvalidVolume, s)
+	}
+}
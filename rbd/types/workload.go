@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"strings"
 
 	"github.com/cockroachdb/errors"
 	resourcetypes "github.com/projecteru2/core/resource/types"
@@ -9,7 +10,10 @@ import (
 
 // WorkloadResource indicate RBD workload resource
 type WorkloadResource struct {
-	Volumes   VolumeBindings `json:"volumes" mapstructure:"volumes"`
+	Volumes VolumeBindings `json:"volumes" mapstructure:"volumes"`
+	// Origin is only used by delta resource of realloc, it includes the volumes before realloc,
+	// so the delta is Volumes minus Origin
+	Origin    VolumeBindings `json:"origin,omitempty" mapstructure:"origin"`
 	totalSize int64
 }
 
@@ -20,9 +24,13 @@ func NewWorkloadResoure() *WorkloadResource {
 }
 
 func (w *WorkloadResource) AsRawParams() resourcetypes.RawParams {
-	return resourcetypes.RawParams{
+	params := resourcetypes.RawParams{
 		"volumes": w.Volumes,
 	}
+	if len(w.Origin) > 0 {
+		params["origin"] = w.Origin
+	}
+	return params
 }
 
 func (w *WorkloadResource) Size() int64 {
@@ -36,6 +44,19 @@ func (w *WorkloadResource) Size() int64 {
 	return w.totalSize
 }
 
+// AsNodeResource returns the node resource occupied by this workload
+func (w *WorkloadResource) AsNodeResource() *NodeResource {
+	pools := w.Volumes.PoolSizes()
+	pools.Sub(w.Origin.PoolSizes())
+	qos := w.Volumes.QoS()
+	qos.Sub(w.Origin.QoS())
+	return &NodeResource{
+		Pools:         pools,
+		QoS:           *qos,
+		MappedVolumes: len(w.Volumes) - len(w.Origin),
+	}
+}
+
 func (w *WorkloadResource) DeepCopy() *WorkloadResource {
 	ans := &WorkloadResource{
 		Volumes:   VolumeBindings{},
@@ -44,6 +65,9 @@ func (w *WorkloadResource) DeepCopy() *WorkloadResource {
 	for _, vb := range w.Volumes {
 		ans.Volumes = append(ans.Volumes, vb.DeepCopy())
 	}
+	for _, vb := range w.Origin {
+		ans.Origin = append(ans.Origin, vb.DeepCopy())
+	}
 	return ans
 }
 
@@ -54,13 +78,21 @@ func (w *WorkloadResource) Parse(rawParams resourcetypes.RawParams) (err error)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(body, w)
+	if err := json.Unmarshal(body, w); err != nil {
+		return err
+	}
+	if err := w.Volumes.validateNoAction(); err != nil {
+		return err
+	}
+	return w.Origin.validateNoAction()
 }
 
 // WorkloadResourceRaw includes all possible fields passed by eru-core for editing workload
 // for request calculation
 type WorkloadResourceRequest struct {
 	Volumes VolumeBindings `json:"volumes" mapstructure:"volumes"`
+	// Detach includes the destinations of volumes which should be removed by realloc
+	Detach []string `json:"detach" mapstructure:"detach"`
 }
 
 func (w *WorkloadResourceRequest) DeepCopy() *WorkloadResourceRequest {
@@ -69,12 +101,132 @@ func (w *WorkloadResourceRequest) DeepCopy() *WorkloadResourceRequest {
 		newVB := *vb
 		ans.Volumes = append(ans.Volumes, &newVB)
 	}
+	ans.Detach = append(ans.Detach, w.Detach...)
 	return ans
 }
 
 // Validate .
 func (w *WorkloadResourceRequest) Validate() error {
-	return w.Volumes.Validate()
+	if err := w.Volumes.Validate(); err != nil {
+		return err
+	}
+	seenDest := map[string]bool{}
+	for _, vb := range w.Volumes {
+		// the size of clone is accounted by itself rather than the parent, so it must be given
+		if vb.GetParent() != "" && vb.Action == ReallocResize && vb.SizeInBytes <= 0 {
+			return errors.Wrapf(ErrInvalidVolumes, "clone %s must have positive size", vb.ToString(false))
+		}
+		seenDest[vb.Destination] = true
+	}
+	for _, dst := range w.Detach {
+		if dst == "" {
+			return errors.Wrap(ErrInvalidVolumes, "empty detach destination")
+		}
+		if seenDest[dst] {
+			return errors.Wrapf(ErrInvalidVolumes, "destination %s is detached and changed at the same time", dst)
+		}
+		seenDest[dst] = true
+	}
+	return nil
+}
+
+// ValidateDeploy returns error if the request is invalid for deploy,
+// absolute size and detach are only used by realloc
+func (w *WorkloadResourceRequest) ValidateDeploy() error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+	if len(w.Detach) > 0 {
+		return errors.Wrap(ErrInvalidVolumes, "detach is only allowed in realloc request")
+	}
+	return w.Volumes.validateNoAction()
+}
+
+// ApplyTo returns the volumes after applying the realloc request to origin volumes:
+// detached volumes are removed, volumes with absolute size or without size replace the origin ones,
+// and the other volumes are merged with the origin ones. The volumes are never removed by size.
+func (w *WorkloadResourceRequest) ApplyTo(origin VolumeBindings) (VolumeBindings, error) {
+	detached := map[string]bool{}
+	for _, dst := range w.Detach {
+		detached[dst] = true
+	}
+	replaced := map[[4]string]*VolumeBinding{}
+	resized := VolumeBindings{}
+	for _, vb := range w.Volumes {
+		if vb.Action == ReallocResize {
+			resized = append(resized, vb)
+			continue
+		}
+		replaced[vb.GetMapKey()] = vb
+	}
+
+	volumes := VolumeBindings{}
+	for _, vb := range origin {
+		if detached[vb.Destination] {
+			delete(detached, vb.Destination)
+			continue
+		}
+		newVB := vb.DeepCopy()
+		if req, ok := replaced[vb.GetMapKey()]; ok {
+			if req.IsBlock() != vb.IsBlock() {
+				return nil, errors.Wrapf(ErrInvalidVolumes, "can't change block mode of %s", vb.Destination)
+			}
+			for _, key := range immutableOptions {
+				if value, ok := req.Options[key]; ok && value != vb.Options[key] {
+					return nil, errors.Wrapf(ErrInvalidVolumes, "can't change %s of %s", key, vb.Destination)
+				}
+			}
+			delete(replaced, vb.GetMapKey())
+			if req.hasFlags() {
+				newVB.Flags = req.Flags
+			}
+			if req.hasQoS {
+				newVB.ReadIOPS = req.ReadIOPS
+				newVB.WriteIOPS = req.WriteIOPS
+				newVB.ReadBPS = req.ReadBPS
+				newVB.WriteBPS = req.WriteBPS
+			}
+			newVB.Options = newVB.Options.Merge(req.Options)
+			if req.Action == ReallocSet {
+				newVB.SizeInBytes = req.SizeInBytes
+			}
+		}
+		volumes = append(volumes, newVB)
+	}
+	for _, dst := range w.Detach {
+		if detached[dst] {
+			return nil, errors.Wrapf(ErrInvalidVolumes, "can't detach %s, no volume is bound to it", dst)
+		}
+	}
+	for _, vb := range w.Volumes {
+		if _, ok := replaced[vb.GetMapKey()]; ok {
+			return nil, errors.Wrapf(ErrInvalidVolumes, "can't %s %s, volume doesn't exist", vb.Action, vb.ToString(false))
+		}
+	}
+	// volumes are removed by detach only, rather than shrinking them to zero
+	sizes := map[[4]string]int64{}
+	for _, vb := range volumes {
+		sizes[vb.GetMapKey()] = vb.SizeInBytes
+	}
+	for _, vb := range resized {
+		if vb.SizeInBytes >= 0 {
+			continue
+		}
+		size, ok := sizes[vb.GetMapKey()]
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidVolumes, "can't shrink %s, volume doesn't exist", vb.ToString(false))
+		}
+		if size+vb.SizeInBytes <= 0 {
+			return nil, errors.Wrapf(ErrInvalidVolumes, "can't shrink %s to %d, use volumes-detach to remove it", vb.Destination, size+vb.SizeInBytes)
+		}
+	}
+	// volumes are removed by detach only, so the bindings without size are kept
+	volumes = mergeVolumeBindings(resized, volumes)
+	// force shrink flag only makes sense in request
+	for _, vb := range volumes {
+		vb.Flags = strings.ReplaceAll(vb.Flags, "f", "")
+	}
+	return volumes, nil
 }
 
 // Parse .
@@ -82,5 +234,6 @@ func (w *WorkloadResourceRequest) Parse(rawParams resourcetypes.RawParams) (err
 	if w.Volumes, err = NewVolumeBindings(rawParams.OneOfStringSlice("volumes", "volume-request", "volumes-request")); err != nil {
 		return errors.Wrap(err, "failed to parse workload resource request")
 	}
+	w.Detach = rawParams.OneOfStringSlice("volumes-detach", "volume-detach")
 	return nil
 }
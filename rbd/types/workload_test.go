@@ -54,3 +54,128 @@ func TestWorkloadResourceRequest(t *testing.T) {
 	err = req.Parse(params)
 	assert.Error(t, req.Validate())
 }
+
+func TestWorkloadResourceRequestApplyTo(t *testing.T) {
+	origin, err := NewVolumeBindings([]string{
+		"eru/img0:/dir0:rw:1GiB;fs=xfs",
+		"eru/img1:/dir1:rw:1GiB;fs=ext4,mount=noatime",
+		"eru/img2:/dir2:rw:1GiB",
+	})
+	assert.NoError(t, err)
+	req := &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{
+		"volumes": []string{
+			"eru/img0:/dir0:rw:1GiB",
+			"eru/img1:/dir1:r:=;mount=nodiratime",
+		},
+		"volumes-detach": []string{"/dir2"},
+	}))
+	assert.NoError(t, req.Validate())
+	vbs, err := req.ApplyTo(origin)
+	assert.NoError(t, err)
+	volumes := []string{}
+	for _, vb := range vbs {
+		volumes = append(volumes, vb.ToString(true))
+	}
+	assert.Equal(t, []string{
+		"eru/img0:/dir0:rw:2147483648;fs=xfs",
+		"eru/img1:/dir1:r:1073741824;fs=ext4,mount=nodiratime",
+	}, volumes)
+
+	// volumes without size are kept by realloc of other volumes
+	origin, err = NewVolumeBindings([]string{"eru/img0:/dir0:rw", "eru/img1:/dir1:rw:1GiB"})
+	assert.NoError(t, err)
+	req = &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{"volumes": []string{"eru/img1:/dir1:rw:1GiB"}}))
+	vbs, err = req.ApplyTo(origin)
+	assert.NoError(t, err)
+	assert.Len(t, vbs, 2)
+	assert.Equal(t, "/dir0", vbs[0].Destination)
+	assert.Zero(t, vbs[0].SizeInBytes)
+	actions := NewVolumeActions(origin, vbs)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, VolumeGrow, actions[0].Type)
+
+	// the flags only used by plugin don't change the volume in engine
+	origin, err = NewVolumeBindings([]string{"eru/img0:/dir0:rw:1GiB"})
+	assert.NoError(t, err)
+	vbs, err = NewVolumeBindings([]string{"eru/img0:/dir0:mrws:1GiB"})
+	assert.NoError(t, err)
+	assert.Empty(t, NewVolumeActions(origin, vbs))
+	vbs, err = NewVolumeBindings([]string{"eru/img0:/dir0:r:1GiB"})
+	assert.NoError(t, err)
+	actions = NewVolumeActions(origin, vbs)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, VolumeFlagsUpdate, actions[0].Type)
+	assert.NotEqual(t, actions[0].Old, actions[0].New)
+
+	// the flags and QoS of origin are kept unless they are given
+	origin, err = NewVolumeBindings([]string{"eru/img0:/dir0:rwm:10GiB:100:100:0:0"})
+	assert.NoError(t, err)
+	for volume, expected := range map[string]string{
+		"eru/img0:/dir0:rw:=20GiB":         "eru/img0:/dir0:mrw:21474836480:100:100:0:0",
+		"eru/img0:/dir0:frw:=5GiB":         "eru/img0:/dir0:mrw:5368709120:100:100:0:0",
+		"eru/img0:/dir0:r:=":               "eru/img0:/dir0:r:10737418240:100:100:0:0",
+		"eru/img0:/dir0:rw:=:0:50":         "eru/img0:/dir0:mrw:10737418240:0:50:0:0",
+		"eru/img0:/dir0:rw:=20GiB:0:0:0:0": "eru/img0:/dir0:mrw:21474836480:0:0:0:0",
+	} {
+		req = &WorkloadResourceRequest{}
+		assert.NoError(t, req.Parse(resourcetypes.RawParams{"volumes": []string{volume}}))
+		vbs, err = req.ApplyTo(origin)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, vbs[0].ToString(false), volume)
+	}
+
+	// filesystem can't be changed after image is formatted
+	for _, volume := range []string{
+		"eru/img0:/dir0:rw:=;fs=ext4",
+		"eru/img0:/dir0:rw:=;fs=xfs,mkfs=nodiscard",
+		"eru/img2:/dir2:rw:=;fs=xfs",
+	} {
+		req = &WorkloadResourceRequest{}
+		assert.NoError(t, req.Parse(resourcetypes.RawParams{"volumes": []string{volume}}))
+		_, err = req.ApplyTo(origin)
+		assert.ErrorIs(t, err, ErrInvalidVolumes, volume)
+	}
+
+	// image layout can't be changed
+	origin, err = NewVolumeBindings([]string{"eru/img0:/dir0:rw:1GiB;object_size=4MiB"})
+	assert.NoError(t, err)
+	req = &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{
+		"volumes": []string{"eru/img0:/dir0:rw:=;object_size=8MiB"},
+	}))
+	_, err = req.ApplyTo(origin)
+	assert.ErrorIs(t, err, ErrInvalidVolumes)
+	req = &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{
+		"volumes": []string{"eru/img0:/dir0:rw:=;object_size=4MiB,features=layering"},
+	}))
+	vbs, err = req.ApplyTo(origin)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"layering"}, vbs[0].Features())
+
+	// encryption can't be added to existing image
+	req = &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{
+		"volumes": []string{"eru/img0:/dir0:rw:=;encryption=luks2,encryption_secret=img0-passphrase"},
+	}))
+	_, err = req.ApplyTo(origin)
+	assert.ErrorIs(t, err, ErrInvalidVolumes)
+
+	// passphrase secret can't be changed
+	origin, err = NewVolumeBindings([]string{"eru/img0:/dir0:rw:1GiB;encryption=luks2,encryption_secret=img0-passphrase"})
+	assert.NoError(t, err)
+	req = &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{
+		"volumes": []string{"eru/img0:/dir0:rw:=;encryption=luks2,encryption_secret=img0-passphrase-v2"},
+	}))
+	_, err = req.ApplyTo(origin)
+	assert.ErrorIs(t, err, ErrInvalidVolumes)
+	req = &WorkloadResourceRequest{}
+	assert.NoError(t, req.Parse(resourcetypes.RawParams{
+		"volumes": []string{"eru/img0:/dir0:rw:+1GiB;encryption=luks2,encryption_secret=img0-passphrase"},
+	}))
+	_, err = req.ApplyTo(origin)
+	assert.NoError(t, err)
+}